@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/broker"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/gorilla/mux"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// New returns the handler for the broker's operator endpoints. These are not
+// part of the service broker API and are served under /admin.
+func New(serviceBroker *broker.CredhubServiceBroker, reconciler *broker.Reconciler, logger lager.Logger) http.Handler {
+	handler := adminHandler{serviceBroker: serviceBroker, reconciler: reconciler, logger: logger.Session("admin")}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/reconcile", handler.reconcile).Methods("POST")
+	router.HandleFunc("/admin/service_instances/{instance_id}/versions", handler.versions).Methods("GET")
+	router.HandleFunc("/admin/service_instances/{instance_id}/bindings", handler.bindings).Methods("GET")
+
+	return router
+}
+
+type adminHandler struct {
+	serviceBroker *broker.CredhubServiceBroker
+	reconciler    *broker.Reconciler
+	logger        lager.Logger
+}
+
+// reconcile runs the reconciler once. Orphans are deleted when the delete
+// query parameter is true and only reported otherwise.
+func (h adminHandler) reconcile(w http.ResponseWriter, req *http.Request) {
+	deleteOrphans := h.reconciler.DeleteOrphans
+	if value := req.FormValue("delete"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			h.respond(w, http.StatusBadRequest, brokerapi.ErrorResponse{Description: "delete must be true or false"})
+			return
+		}
+		deleteOrphans = parsed
+	}
+
+	report, err := h.reconciler.Reconcile(deleteOrphans)
+	if err != nil {
+		h.logger.Error("reconcile-failed", err)
+		h.respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+		return
+	}
+
+	h.respond(w, http.StatusOK, report)
+}
+
+// versions lists the ids and creation times of an instance's credential
+// versions, for choosing one to restore. Values are never returned.
+func (h adminHandler) versions(w http.ResponseWriter, req *http.Request) {
+	serviceID := req.FormValue("service_id")
+	if serviceID == "" {
+		serviceID = broker.ServiceID
+	}
+
+	versions, err := h.serviceBroker.CredentialVersions(serviceID, mux.Vars(req)["instance_id"])
+	switch {
+	case err == store.ErrNotFound:
+		h.respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: "service instance does not exist"})
+	case err != nil:
+		h.logger.Error("listing-versions-failed", err)
+		h.respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	default:
+		h.respond(w, http.StatusOK, map[string]interface{}{"versions": versions})
+	}
+}
+
+// bindings lists an instance's bindings and the spaces they were made from,
+// showing which spaces the instance is shared into hold bindings.
+func (h adminHandler) bindings(w http.ResponseWriter, req *http.Request) {
+	serviceID := req.FormValue("service_id")
+	if serviceID == "" {
+		serviceID = broker.ServiceID
+	}
+
+	bindings, err := h.serviceBroker.InstanceBindings(serviceID, mux.Vars(req)["instance_id"])
+	switch {
+	case err == store.ErrNotFound:
+		h.respond(w, http.StatusNotFound, brokerapi.ErrorResponse{Description: "service instance does not exist"})
+	case err != nil:
+		h.logger.Error("listing-bindings-failed", err)
+		h.respond(w, http.StatusInternalServerError, brokerapi.ErrorResponse{Description: err.Error()})
+	default:
+		h.respond(w, http.StatusOK, bindings)
+	}
+}
+
+func (h adminHandler) respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(response); err != nil {
+		h.logger.Error("encoding-response", err, lager.Data{"status": status})
+	}
+}
@@ -0,0 +1,70 @@
+// Package audit records who changed which credentials and permissions, and
+// whether the change succeeded. Events never contain credential values.
+package audit
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeAccepted  = "accepted"
+	OutcomeUnchanged = "unchanged"
+)
+
+type Event struct {
+	Time      string    `json:"time"`
+	Operation string    `json:"operation"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Identity  *Identity `json:"originating_identity,omitempty"`
+
+	ServiceID        string `json:"service_id,omitempty"`
+	PlanID           string `json:"plan_id,omitempty"`
+	PreviousPlanID   string `json:"previous_plan_id,omitempty"`
+	InstanceID       string `json:"instance_id,omitempty"`
+	BindingID        string `json:"binding_id,omitempty"`
+	Platform         string `json:"platform,omitempty"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	Namespace        string `json:"namespace,omitempty"`
+	ClusterID        string `json:"cluster_id,omitempty"`
+
+	CredHubPath   string   `json:"credhub_path,omitempty"`
+	ActorsAdded   []string `json:"actors_added,omitempty"`
+	ActorsRemoved []string `json:"actors_removed,omitempty"`
+}
+
+// Sink stores audit events somewhere other than the broker's own logs.
+type Sink interface {
+	Write(event Event) error
+}
+
+// Logger writes events to every sink. A nil Logger discards them.
+type Logger struct {
+	sinks  []Sink
+	logger lager.Logger
+}
+
+func NewLogger(logger lager.Logger, sinks ...Sink) *Logger {
+	return &Logger{sinks: sinks, logger: logger.Session("audit")}
+}
+
+func (auditLogger *Logger) Record(event Event) {
+	if auditLogger == nil {
+		return
+	}
+
+	if event.Time == "" {
+		event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	for _, sink := range auditLogger.sinks {
+		if err := sink.Write(event); err != nil {
+			auditLogger.logger.Error("write-event-failed", err, lager.Data{"operation": event.Operation, "instance-id": event.InstanceID})
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(event Event) error {
+	return errors.New("sink unavailable")
+}
+
+func TestNilLoggerDiscardsEvents(t *testing.T) {
+	var auditLogger *Logger
+	auditLogger.Record(Event{Operation: "provision", Outcome: OutcomeSucceeded})
+}
+
+func TestLoggerWritesToEverySink(t *testing.T) {
+	var logs, first, second bytes.Buffer
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(&logs, lager.DEBUG))
+
+	auditLogger := NewLogger(logger, NewWriterSink(&first), failingSink{}, NewWriterSink(&second))
+	auditLogger.Record(Event{Operation: "provision", Outcome: OutcomeSucceeded, InstanceID: "instance"})
+
+	for _, buffer := range []*bytes.Buffer{&first, &second} {
+		events := readEvents(t, buffer.Bytes())
+		if len(events) != 1 {
+			t.Fatalf("expected one event in each sink, got %d", len(events))
+		}
+		if _, err := time.Parse(time.RFC3339Nano, events[0].Time); err != nil {
+			t.Errorf("expected the event to be timestamped, got %q", events[0].Time)
+		}
+	}
+
+	if !strings.Contains(logs.String(), "write-event-failed") || !strings.Contains(logs.String(), "sink unavailable") {
+		t.Errorf("expected the failing sink to be logged, got %s", logs.String())
+	}
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+// Identity is the platform user a request was made on behalf of, from the
+// originating identity header.
+type Identity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value,omitempty"`
+}
+
+// ParseIdentity parses an originating identity header, a platform name
+// followed by a base64 encoded JSON object.
+func ParseIdentity(header string) (*Identity, error) {
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return nil, errors.New("originating identity must be a platform and a base64 encoded value")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Platform: fields[0]}
+	if err := json.Unmarshal(data, &identity.Value); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) *Identity {
+	if ctx == nil {
+		return nil
+	}
+	identity, _ := ctx.Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// IdentityHandler puts the originating identity of each request in its
+// context. A header that cannot be parsed is recorded by platform only.
+func IdentityHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		header := strings.TrimSpace(req.Header.Get(OriginatingIdentityHeader))
+		if header == "" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		identity, err := ParseIdentity(header)
+		if err != nil {
+			identity = &Identity{Platform: strings.Fields(header)[0]}
+		}
+
+		handler.ServeHTTP(w, req.WithContext(WithIdentity(req.Context(), identity)))
+	})
+}
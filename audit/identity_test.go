@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func identityHeader(platform, value string) string {
+	return platform + " " + base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func TestParseIdentity(t *testing.T) {
+	identity, err := ParseIdentity(identityHeader("cloudfoundry", `{"user_id":"683ea748-3092-4ff4-b656-39cacc4d5360"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Identity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id": "683ea748-3092-4ff4-b656-39cacc4d5360"}}
+	if !reflect.DeepEqual(identity, expected) {
+		t.Errorf("expected %+v, got %+v", expected, identity)
+	}
+
+	for _, header := range []string{
+		"cloudfoundry",
+		"cloudfoundry not-base64!",
+		identityHeader("cloudfoundry", `not json`),
+		identityHeader("cloudfoundry", `["user"]`),
+		identityHeader("cloudfoundry", `{}`) + " extra",
+	} {
+		if _, err := ParseIdentity(header); err == nil {
+			t.Errorf("%q: expected an error", header)
+		}
+	}
+}
+
+func TestIdentityHandler(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		header   string
+		identity *Identity
+	}{
+		{"no header", "", nil},
+		{"valid header", identityHeader("kubernetes", `{"username":"admin"}`), &Identity{Platform: "kubernetes", Value: map[string]interface{}{"username": "admin"}}},
+		{"header that cannot be parsed", "cloudfoundry not-base64!", &Identity{Platform: "cloudfoundry"}},
+	} {
+		var identity *Identity
+		handler := IdentityHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			identity = IdentityFromContext(req.Context())
+		}))
+
+		request := httptest.NewRequest("PUT", "/v2/service_instances/instance", nil)
+		if test.header != "" {
+			request.Header.Set(OriginatingIdentityHeader, test.header)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+
+		if !reflect.DeepEqual(identity, test.identity) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.identity, identity)
+		}
+	}
+
+	if identity := IdentityFromContext(nil); identity != nil {
+		t.Errorf("expected no identity without a context, got %+v", identity)
+	}
+}
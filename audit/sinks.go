@@ -0,0 +1,116 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// WriterSink writes each event as a line of JSON.
+type WriterSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func NewWriterSink(writer io.Writer) *WriterSink {
+	return &WriterSink{writer: writer}
+}
+
+func (writerSink *WriterSink) Write(event Event) error {
+	line, err := jsonLine(event)
+	if err != nil {
+		return err
+	}
+
+	writerSink.mutex.Lock()
+	defer writerSink.mutex.Unlock()
+
+	_, err = writerSink.writer.Write(line)
+	return err
+}
+
+func jsonLine(event Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// FileSink appends each event as a line of JSON to the file at a path. Reopen
+// opens the path again, so the file can be rotated by moving it aside.
+type FileSink struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+// NewFileSink appends events to the file at path, creating it if needed.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{path: path, file: file}, nil
+}
+
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
+
+func (fileSink *FileSink) Write(event Event) error {
+	line, err := jsonLine(event)
+	if err != nil {
+		return err
+	}
+
+	fileSink.mutex.Lock()
+	defer fileSink.mutex.Unlock()
+
+	_, err = fileSink.file.Write(line)
+	return err
+}
+
+// Reopen closes the file and opens its path again. When the path cannot be
+// opened, events keep going to the file that was open.
+func (fileSink *FileSink) Reopen() error {
+	file, err := openAppend(fileSink.path)
+	if err != nil {
+		return err
+	}
+
+	fileSink.mutex.Lock()
+	defer fileSink.mutex.Unlock()
+
+	previous := fileSink.file
+	fileSink.file = file
+	return previous.Close()
+}
+
+// SyslogSink sends each event as JSON to a syslog daemon.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at address, or to the local
+// one when network and address are empty.
+func NewSyslogSink(network, address, tag string) (*SyslogSink, error) {
+	writer, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (syslogSink *SyslogSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return syslogSink.writer.Info(string(data))
+}
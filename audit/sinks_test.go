@@ -0,0 +1,170 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func readEvents(t *testing.T, data []byte) []Event {
+	t.Helper()
+	events := []Event{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("expected a line of JSON, got %q: %s", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestWriterSinkWritesALineOfJSONPerEvent(t *testing.T) {
+	var buffer bytes.Buffer
+	sink := NewWriterSink(&buffer)
+
+	event := Event{
+		Time:        "2026-01-02T03:04:05Z",
+		Operation:   "bind",
+		Outcome:     OutcomeSucceeded,
+		Identity:    &Identity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id": "user"}},
+		InstanceID:  "instance",
+		BindingID:   "binding",
+		CredHubPath: "/c/broker/service/instance/credentials",
+		ActorsAdded: []string{"mtls-app:app-guid"},
+	}
+	if err := sink.Write(event); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"time":"2026-01-02T03:04:05Z","operation":"bind","outcome":"succeeded",` +
+		`"originating_identity":{"platform":"cloudfoundry","value":{"user_id":"user"}},` +
+		`"instance_id":"instance","binding_id":"binding","credhub_path":"/c/broker/service/instance/credentials",` +
+		`"actors_added":["mtls-app:app-guid"]}` + "\n"
+	if buffer.String() != expected {
+		t.Errorf("expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestWriterSinkKeepsConcurrentEventsOnSeparateLines(t *testing.T) {
+	var buffer bytes.Buffer
+	sink := NewWriterSink(&buffer)
+
+	var wait sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			sink.Write(Event{Operation: "provision", Outcome: OutcomeSucceeded, InstanceID: strings.Repeat("i", 512)})
+		}()
+	}
+	wait.Wait()
+
+	if events := readEvents(t, buffer.Bytes()); len(events) != 20 {
+		t.Errorf("expected 20 events, got %d", len(events))
+	}
+}
+
+func TestFileSinkAppendsAndReopens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	if err := ioutil.WriteFile(path, []byte(`{"operation":"existing"}`+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(Event{Operation: "provision"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// log rotation moves the file aside and asks for it to be reopened
+	rotated := filepath.Join(dir, "audit.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(Event{Operation: "bind"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(Event{Operation: "unbind"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		path       string
+		operations []string
+	}{
+		{rotated, []string{"existing", "provision", "bind"}},
+		{path, []string{"unbind"}},
+	} {
+		data, err := ioutil.ReadFile(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		operations := []string{}
+		for _, event := range readEvents(t, data) {
+			operations = append(operations, event.Operation)
+		}
+		if strings.Join(operations, ",") != strings.Join(test.operations, ",") {
+			t.Errorf("%s: expected %v, got %v", filepath.Base(test.path), test.operations, operations)
+		}
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the reopened file to be private, got %v and %v", info, err)
+	}
+}
+
+func TestFileSinkErrors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewFileSink(filepath.Join(dir, "missing", "audit.log")); err == nil {
+		t.Error("expected a file in a missing directory to be rejected")
+	}
+
+	logDir := filepath.Join(dir, "logs")
+	if err := os.Mkdir(logDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(logDir, "audit.log")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a path that cannot be opened again keeps events going to the open file
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(logDir, moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Reopen(); err == nil {
+		t.Error("expected reopening a missing directory to fail")
+	}
+	if err := sink.Write(Event{Operation: "provision"}); err != nil {
+		t.Errorf("expected the open file to keep working, got %s", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(moved, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events := readEvents(t, data); len(events) != 1 || events[0].Operation != "provision" {
+		t.Errorf("expected the event in the open file, got %v", events)
+	}
+
+	sink.file.Close()
+	if err := sink.Write(Event{Operation: "bind"}); err == nil {
+		t.Error("expected a write to a closed file to fail")
+	}
+}
@@ -0,0 +1,166 @@
+package basicauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const notAuthorized = "Not Authorized"
+
+// ErrNoCredentials is returned when loading credentials that are not
+// configured at all.
+var ErrNoCredentials = errors.New("no credentials are configured")
+
+// Credential is a username and password accepted by a Wrapper. The password
+// is either plaintext or a bcrypt hash such as one from `htpasswd -nbB`.
+type Credential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (credential Credential) hashed() bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(credential.Password, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrapper requires HTTP basic auth matching any one of its credentials, so a
+// new pair can be added before the old one is removed.
+type Wrapper struct {
+	credentials []Credential
+
+	// verified holds the digest of the last pair that matched each
+	// credential, so it never grows beyond the configured credentials
+	mutex    sync.RWMutex
+	verified [][sha256.Size]byte
+}
+
+func NewWrapper(credentials []Credential) *Wrapper {
+	return &Wrapper{
+		credentials: credentials,
+		verified:    make([][sha256.Size]byte, len(credentials)),
+	}
+}
+
+func (wrapper *Wrapper) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !wrapper.Authorized(username, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="secure-credentials-broker"`)
+			http.Error(w, notAuthorized, http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (wrapper *Wrapper) Authorized(username, password string) bool {
+	// bcrypt is deliberately slow, so remember pairs that already matched
+	digest := sha256.Sum256([]byte(username + ":" + password))
+	wrapper.mutex.RLock()
+	for _, verified := range wrapper.verified {
+		if subtle.ConstantTimeCompare(digest[:], verified[:]) == 1 {
+			wrapper.mutex.RUnlock()
+			return true
+		}
+	}
+	wrapper.mutex.RUnlock()
+
+	authorized := false
+	matched := 0
+	for i, credential := range wrapper.credentials {
+		if subtle.ConstantTimeCompare([]byte(username), []byte(credential.Username)) != 1 {
+			continue
+		}
+
+		if credential.hashed() {
+			authorized = bcrypt.CompareHashAndPassword([]byte(credential.Password), []byte(password)) == nil
+		} else {
+			authorized = subtle.ConstantTimeCompare([]byte(password), []byte(credential.Password)) == 1
+		}
+
+		if authorized {
+			matched = i
+			break
+		}
+	}
+
+	if authorized {
+		wrapper.mutex.Lock()
+		wrapper.verified[matched] = digest
+		wrapper.mutex.Unlock()
+	}
+
+	return authorized
+}
+
+// LoadCredentials reads credentials from the environment. With a prefix of
+// BROKER it reads a single pair from BROKER_USERNAME and BROKER_PASSWORD, a
+// JSON list of pairs from BROKER_CREDENTIALS, and a file containing such a
+// list from BROKER_CREDENTIALS_FILE. All sources are combined.
+func LoadCredentials(prefix string) ([]Credential, error) {
+	credentials := []Credential{}
+
+	username := os.Getenv(prefix + "_USERNAME")
+	password := os.Getenv(prefix + "_PASSWORD")
+	if username != "" || password != "" {
+		credentials = append(credentials, Credential{Username: username, Password: password})
+	}
+
+	if list := os.Getenv(prefix + "_CREDENTIALS"); list != "" {
+		var listed []Credential
+		if err := json.Unmarshal([]byte(list), &listed); err != nil {
+			return nil, fmt.Errorf("%s_CREDENTIALS is not a JSON list of credentials: %s", prefix, err)
+		}
+		credentials = append(credentials, listed...)
+	}
+
+	if path := os.Getenv(prefix + "_CREDENTIALS_FILE"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var listed []Credential
+		if err := json.Unmarshal(data, &listed); err != nil {
+			return nil, fmt.Errorf("%s is not a JSON list of credentials: %s", path, err)
+		}
+		credentials = append(credentials, listed...)
+	}
+
+	return credentials, Validate(credentials)
+}
+
+func Validate(credentials []Credential) error {
+	if len(credentials) == 0 {
+		return ErrNoCredentials
+	}
+
+	for _, credential := range credentials {
+		if credential.Username == "" || credential.Password == "" {
+			return errors.New("every credential requires a username and a password")
+		}
+
+		if credential.hashed() {
+			if _, err := bcrypt.Cost([]byte(credential.Password)); err != nil {
+				return fmt.Errorf("password for %q is not a valid bcrypt hash: %s", credential.Username, err)
+			}
+		}
+	}
+
+	return nil
+}
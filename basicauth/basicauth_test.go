@@ -0,0 +1,158 @@
+package basicauth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	t.Helper()
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hashed)
+}
+
+func TestAuthorized(t *testing.T) {
+	wrapper := NewWrapper([]Credential{
+		{Username: "admin", Password: "plain"},
+		{Username: "admin", Password: hash(t, "rotated")},
+		{Username: "other", Password: hash(t, "hashed")},
+	})
+
+	for _, test := range []struct {
+		username, password string
+		authorized         bool
+	}{
+		{"admin", "plain", true},
+		{"admin", "rotated", true},
+		{"other", "hashed", true},
+		{"admin", "hashed", false},
+		{"other", "plain", false},
+		{"admin", "", false},
+		{"", "plain", false},
+		{"Admin", "plain", false},
+		{"admin", "plain ", false},
+		{"admin", hash(t, "rotated"), false},
+	} {
+		// the second attempt is answered from the verified pairs
+		for attempt := 0; attempt < 2; attempt++ {
+			if authorized := wrapper.Authorized(test.username, test.password); authorized != test.authorized {
+				t.Errorf("%s:%s attempt %d: expected %t, got %t", test.username, test.password, attempt, test.authorized, authorized)
+			}
+		}
+	}
+}
+
+func TestVerifiedPairsAreBoundedByTheCredentials(t *testing.T) {
+	wrapper := NewWrapper([]Credential{{Username: "admin", Password: hash(t, "secret")}})
+
+	for i := 0; i < 3; i++ {
+		wrapper.Authorized("admin", "secret")
+		wrapper.Authorized("admin", "wrong")
+	}
+
+	if len(wrapper.verified) != 1 {
+		t.Errorf("expected one verified pair, got %d", len(wrapper.verified))
+	}
+	if wrapper.Authorized("admin", "wrong") {
+		t.Error("expected a wrong password to stay unauthorized")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	handler := NewWrapper([]Credential{{Username: "admin", Password: "secret"}}).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for _, test := range []struct {
+		setAuth  bool
+		password string
+		status   int
+	}{
+		{false, "", http.StatusUnauthorized},
+		{true, "wrong", http.StatusUnauthorized},
+		{true, "secret", http.StatusTeapot},
+	} {
+		request := httptest.NewRequest("GET", "/v2/catalog", nil)
+		if test.setAuth {
+			request.SetBasicAuth("admin", test.password)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.status {
+			t.Errorf("password %q: expected %d, got %d", test.password, test.status, recorder.Code)
+		}
+		if test.status == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("password %q: expected a WWW-Authenticate challenge", test.password)
+		}
+	}
+}
+
+func TestLoadCredentialsCombinesEverySource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"username":"file","password":"from-file"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_USERNAME", "single")
+	t.Setenv("TEST_PASSWORD", "from-env")
+	t.Setenv("TEST_CREDENTIALS", `[{"username":"listed","password":"from-list"}]`)
+	t.Setenv("TEST_CREDENTIALS_FILE", path)
+
+	credentials, err := LoadCredentials("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Credential{
+		{Username: "single", Password: "from-env"},
+		{Username: "listed", Password: "from-list"},
+		{Username: "file", Password: "from-file"},
+	}
+	if len(credentials) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, credentials)
+	}
+	for i := range expected {
+		if credentials[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], credentials[i])
+		}
+	}
+}
+
+func TestLoadCredentialsErrors(t *testing.T) {
+	if _, err := LoadCredentials("UNSET"); err != ErrNoCredentials {
+		t.Errorf("expected ErrNoCredentials, got %v", err)
+	}
+
+	t.Setenv("INVALID_CREDENTIALS", `{"username":"admin"}`)
+	if _, err := LoadCredentials("INVALID"); err == nil {
+		t.Error("expected credentials that are not a list to be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		credentials []Credential
+		valid       bool
+	}{
+		{"plaintext", []Credential{{Username: "admin", Password: "secret"}}, true},
+		{"bcrypt", []Credential{{Username: "admin", Password: hash(t, "secret")}}, true},
+		{"none", []Credential{}, false},
+		{"no username", []Credential{{Password: "secret"}}, false},
+		{"no password", []Credential{{Username: "admin"}}, false},
+		{"truncated bcrypt", []Credential{{Username: "admin", Password: "$2a$10$abc"}}, false},
+	} {
+		if err := Validate(test.credentials); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/ablease/credhub-broker/audit"
+)
+
+// audit records the outcome of a request. Events that do not set an outcome
+// succeeded unless err is set.
+func (credhubServiceBroker *CredhubServiceBroker) audit(context context.Context, event audit.Event, err error) {
+	event.Identity = audit.IdentityFromContext(context)
+	switch {
+	case err != nil:
+		event.Outcome = audit.OutcomeFailed
+		event.Error = err.Error()
+	case event.Outcome == "":
+		event.Outcome = audit.OutcomeSucceeded
+	}
+
+	credhubServiceBroker.Audit.Record(event)
+}
+
+// audited records the outcome of an asynchronous operation once its work is
+// done. The work can add what it changed to its own copy of the event.
+func (credhubServiceBroker *CredhubServiceBroker) audited(context context.Context, event audit.Event, work func(*audit.Event) error) func() error {
+	return func() error {
+		err := work(&event)
+		credhubServiceBroker.audit(context, event, err)
+		return err
+	}
+}
+
+// auditContext adds where a request came from, as far as its context says.
+func auditContext(event *audit.Event, rawContext json.RawMessage) {
+	var platform platformContext
+	if json.Unmarshal(rawContext, &platform) != nil {
+		return
+	}
+
+	event.Platform = platform.Platform
+	event.Namespace = platform.Namespace
+	event.ClusterID = platform.ClusterID
+	if platform.OrganizationGUID != "" {
+		event.OrganizationGUID = platform.OrganizationGUID
+	}
+	if platform.SpaceGUID != "" {
+		event.SpaceGUID = platform.SpaceGUID
+	}
+}
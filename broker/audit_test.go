@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/audit"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type recordingSink struct {
+	mutex  sync.Mutex
+	events []audit.Event
+}
+
+func (sink *recordingSink) Write(event audit.Event) error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.events = append(sink.events, event)
+	return nil
+}
+
+func (sink *recordingSink) last(operation string) audit.Event {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	for i := len(sink.events) - 1; i >= 0; i-- {
+		if sink.events[i].Operation == operation {
+			return sink.events[i]
+		}
+	}
+	return audit.Event{}
+}
+
+func TestDeprovisionAuditsRemovedActors(t *testing.T) {
+	for _, asyncAllowed := range []bool{false, true} {
+		sink := &recordingSink{}
+		broker := newTestBroker(store.NewMemoryStore())
+		logger := lager.NewLogger("test")
+		logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+		broker.Audit = audit.NewLogger(logger, sink)
+
+		if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+			t.Fatal(err)
+		}
+		_, err := broker.Bind(context.Background(), "instance", "binding", brokerapi.BindDetails{
+			ServiceID: ServiceID,
+			PlanID:    PlanNameDefault,
+			AppGUID:   "app-guid",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		actors := sink.last(OperationBind).ActorsAdded
+
+		_, err = broker.Deprovision(context.Background(), "instance", brokerapi.DeprovisionDetails{
+			ServiceID: ServiceID,
+			PlanID:    PlanNameDefault,
+		}, asyncAllowed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		event := sink.last(OperationDeprovision)
+		if event.Outcome != audit.OutcomeSucceeded {
+			t.Errorf("expected the deprovision to succeed with asyncAllowed %t, got %+v", asyncAllowed, event)
+		}
+		if len(actors) == 0 || !reflect.DeepEqual(event.ActorsRemoved, actors) {
+			t.Errorf("expected actors %v to be removed with asyncAllowed %t, got %v", actors, asyncAllowed, event.ActorsRemoved)
+		}
+	}
+}
+
+// grantFailingStore refuses to grant permissions.
+type grantFailingStore struct {
+	store.Store
+}
+
+func (grantFailingStore) AddPermissions(name string, perms []permissions.Permission) error {
+	return errors.New("permission denied")
+}
+
+func TestFailedBindDoesNotAuditAddedActors(t *testing.T) {
+	sink := &recordingSink{}
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	broker.Audit = audit.NewLogger(logger, sink)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Store = grantFailingStore{credStore}
+	if _, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(``)); err == nil {
+		t.Fatal("expected the bind to fail")
+	}
+
+	event := sink.last(OperationBind)
+	if event.Outcome == audit.OutcomeSucceeded || len(event.ActorsAdded) != 0 {
+		t.Errorf("expected a failed bind without added actors, got %+v", event)
+	}
+}
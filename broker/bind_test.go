@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestRepeatedBindGrantsAccessMissingFromAnEarlierAttempt(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(``)); err != nil {
+		t.Fatal(err)
+	}
+
+	// as if the broker stopped between storing the record and granting access
+	if err := credStore.DeletePermissions(key, "mtls-app:app-guid"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(``)); err != nil {
+		t.Fatal(err)
+	}
+
+	perms, err := credStore.GetPermissions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perms) != 1 || perms[0].Actor != "mtls-app:app-guid" {
+		t.Errorf("expected the binding's permission to be granted, got %+v", perms)
+	}
+}
+
+func TestBindingIDsCannotNameInstanceRecords(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bindingID := range []string{CredentialsID, MetadataID, OperationID} {
+		_, err := broker.Bind(context.Background(), "instance", bindingID, bindDetails(``))
+		if status := failureStatus(t, err); status != http.StatusBadRequest {
+			t.Errorf("binding %s: expected status 400, got %d", bindingID, status)
+		}
+
+		err = broker.Unbind(context.Background(), "instance", bindingID, brokerapi.UnbindDetails{ServiceID: ServiceID, PlanID: PlanNameDefault})
+		if err != brokerapi.ErrBindingDoesNotExist {
+			t.Errorf("unbinding %s: expected the binding not to exist, got %v", bindingID, err)
+		}
+	}
+
+	if _, err := credStore.GetLatestJSON(constructKey(ServiceID, "instance", MetadataID)); err != nil {
+		t.Errorf("expected the instance metadata to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+)
+
+const (
+	BindingCredentialsCopy     = "copy"
+	BindingCredentialsGenerate = "generate"
+)
+
+func validateBindingCredentials(plan Plan) error {
+	switch plan.BindingCredentials {
+	case "", BindingCredentialsCopy:
+		if plan.BindingTemplate != nil {
+			return errors.New("has a binding_template but does not generate binding credentials")
+		}
+	case BindingCredentialsGenerate:
+		if plan.BindingTemplate == nil {
+			return errors.New("generates binding credentials and requires a binding_template")
+		}
+		if !generatedCredentialTypes[plan.BindingTemplate.Generate] {
+			return fmt.Errorf("cannot generate binding credentials of type %q", plan.BindingTemplate.Generate)
+		}
+		if _, err := generateOptions(plan, plan.BindingTemplate.Generate, plan.BindingTemplate.Parameters); err != nil {
+			return fmt.Errorf("has an invalid binding_template: %s", err)
+		}
+	default:
+		return fmt.Errorf("has unknown binding_credentials %q, expected %s or %s", plan.BindingCredentials, BindingCredentialsCopy, BindingCredentialsGenerate)
+	}
+
+	return nil
+}
+
+// bindingCredentialsKey is where a binding's own credential is kept, below
+// the binding record.
+func bindingCredentialsKey(serviceID, instanceID, bindingID string) string {
+	return constructKey(serviceID, instanceID, bindingID+"/"+CredentialsID)
+}
+
+// reservedBindingID reports whether a binding ID is the name of one of the
+// instance's own records, which binding records are stored beside.
+func reservedBindingID(bindingID string) bool {
+	switch bindingID {
+	case CredentialsID, MetadataID, OperationID:
+		return true
+	}
+	return false
+}
+
+// writeBindingCredentials stores a binding's own credential, either a copy of
+// the instance's current value or one generated from the plan's template.
+func (credhubServiceBroker *CredhubServiceBroker) writeBindingCredentials(plan Plan, serviceID, instanceID, key string) error {
+	if plan.BindingCredentials == BindingCredentialsGenerate {
+		options, err := generateOptions(plan, plan.BindingTemplate.Generate, plan.BindingTemplate.Parameters)
+		if err != nil {
+			return err
+		}
+		return credhubServiceBroker.generateCredential(key, options, credhub.Overwrite)
+	}
+
+	return credhubServiceBroker.copyCredential(constructKey(serviceID, instanceID, CredentialsID), key)
+}
+
+// copyToBindings copies the instance's current credential to every binding
+// that holds a copy of it, so bindings serve the value the instance was
+// updated to rather than the one it had when they were made.
+func (credhubServiceBroker *CredhubServiceBroker) copyToBindings(plan Plan, serviceID, instanceID string) error {
+	if plan.BindingCredentials == BindingCredentialsGenerate {
+		return nil
+	}
+
+	records, err := credhubServiceBroker.bindingRecords(serviceID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	instanceKey := constructKey(serviceID, instanceID, CredentialsID)
+	for _, binding := range records {
+		key := binding.credentialName(instanceKey)
+		if key == instanceKey {
+			continue
+		}
+
+		credhubServiceBroker.Logger.Info("copying instance credentials to binding", lager.Data{"binding-id": binding.id, "key": key})
+		if err := credhubServiceBroker.copyCredential(instanceKey, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (credhubServiceBroker *CredhubServiceBroker) copyCredential(from, to string) error {
+	current, err := credhubServiceBroker.Store.GetLatestVersion(from)
+	if err != nil {
+		return err
+	}
+
+	value, err := credentialValue(current)
+	if err != nil {
+		return err
+	}
+
+	return credhubServiceBroker.setCredential(to, current.Type, value)
+}
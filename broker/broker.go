@@ -1,16 +1,18 @@
-p ackage broker
+package broker
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
+	"strings"
+	"sync"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/audit"
+	"github.com/ablease/credhub-broker/store"
 	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
-	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
 	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
 	"github.com/pivotal-cf/brokerapi"
 )
@@ -43,183 +45,725 @@ type InstanceBinder interface {
 type CredhubServiceBroker struct {
 	InstanceCreators map[string]InstanceCreator
 	InstanceBinders  map[string]InstanceBinder
-	CredHubClient    *credhub.CredHub
+	Store            store.Store
+	Catalog          *Catalog
+	KubernetesRules  []KubernetesRule
+	Audit            *audit.Logger
 	Logger           lager.Logger
+
+	jobs              sync.WaitGroup
+	operationsMutex   sync.Mutex
+	runningOperations map[string]operationRecord
+	shuttingDown      bool
 }
 
 func (credhubServiceBroker *CredhubServiceBroker) Services(context context.Context) []brokerapi.Service {
-	planList := []brokerapi.ServicePlan{}
-	for _, plan := range credhubServiceBroker.plans() {
-		planList = append(planList, *plan)
-	}
-
-	return []brokerapi.Service{
-		brokerapi.Service{
-			ID:            ServiceID,
-			Name:          ServiceID,
-			Description:   "Stores configuration parameters securely in CredHub",
-			Bindable:      true,
-			PlanUpdatable: true,
-			Plans:         planList,
-			Metadata: &brokerapi.ServiceMetadata{
-				DisplayName:         "credhub-broker",
-				LongDescription:     "Stores configuration parameters securely in CredHub",
-				DocumentationUrl:    "",
-				SupportUrl:          "",
-				ImageUrl:            "",
-				ProviderDisplayName: "",
-			},
-			Tags: []string{
-				"credhub",
-			},
-		},
-	}
+	return credhubServiceBroker.catalog().BrokerServices()
 }
 
 func (credhubServiceBroker *CredhubServiceBroker) Provision(context context.Context, instanceID string, serviceDetails brokerapi.ProvisionDetails, asyncAllowed bool) (spec brokerapi.ProvisionedServiceSpec, err error) {
-	err = credhubServiceBroker.setJSON(serviceDetails.RawParameters, instanceID, serviceDetails.ServiceID)
+	event := audit.Event{
+		Operation:        OperationProvision,
+		ServiceID:        serviceDetails.ServiceID,
+		PlanID:           serviceDetails.PlanID,
+		InstanceID:       instanceID,
+		OrganizationGUID: serviceDetails.OrganizationGUID,
+		SpaceGUID:        serviceDetails.SpaceGUID,
+		CredHubPath:      constructKey(serviceDetails.ServiceID, instanceID, CredentialsID),
+	}
+	auditContext(&event, serviceDetails.RawContext)
+	defer func() {
+		if spec.IsAsync {
+			event.Outcome = audit.OutcomeAccepted
+		}
+		err = unavailable(context, err)
+		credhubServiceBroker.audit(context, event, err)
+	}()
+
+	plan, err := credhubServiceBroker.findPlan(serviceDetails.ServiceID, serviceDetails.PlanID)
+	if err != nil {
+		return spec, err
+	}
+
+	metadata := instanceMetadata{
+		ServiceID:        serviceDetails.ServiceID,
+		PlanID:           serviceDetails.PlanID,
+		OrganizationGUID: serviceDetails.OrganizationGUID,
+		SpaceGUID:        serviceDetails.SpaceGUID,
+		ParametersHash:   parametersHash(serviceDetails.RawParameters),
+		CreatedAt:        timestamp(),
+	}
+
+	existing, exists, err := credhubServiceBroker.readInstance(serviceDetails.ServiceID, instanceID)
+	if err != nil {
+		return spec, err
+	}
+	if exists {
+		if !existing.matches(metadata) {
+			return spec, brokerapi.ErrInstanceAlreadyExists
+		}
+
+		record, found, err := credhubServiceBroker.readOperation(serviceDetails.ServiceID, instanceID)
+		if err != nil {
+			return spec, err
+		}
+
+		provisioning := found && record.Type == OperationProvision
+		switch {
+		case provisioning && credhubServiceBroker.running(serviceDetails.ServiceID, instanceID, record):
+			if !asyncAllowed {
+				return spec, brokerapi.ErrAsyncRequired
+			}
+			spec.IsAsync = true
+			spec.OperationData = encodeOperationData(record.Type, serviceDetails.ServiceID, record.ID)
+			return spec, nil
+		case provisioning && record.State == brokerapi.Failed:
+			// the earlier attempt failed, so provision again
+		default:
+			markAlreadyExists(context)
+			event.Outcome = audit.OutcomeUnchanged
+			return spec, nil
+		}
+	}
 
+	if err := validateParameters(plan, instanceCreateSchema, serviceDetails.RawParameters); err != nil {
+		return spec, err
+	}
+
+	key := constructKey(serviceDetails.ServiceID, instanceID, CredentialsID)
+	write, err := credhubServiceBroker.prepareCredentials(plan, serviceDetails.RawParameters, key)
 	if err != nil {
 		return spec, err
 	}
 
-	credhubServiceBroker.Logger.Info("successfully stored user-provided credentials for instanceID " + instanceID)
+	// the metadata is written first so repeated requests can be compared
+	// while an asynchronous provision is still running
+	metadataKey := constructKey(serviceDetails.ServiceID, instanceID, MetadataID)
+	if err := credhubServiceBroker.writeRecord(metadataKey, metadata); err != nil {
+		return spec, err
+	}
+
+	discardMetadata := func() {
+		if err := credhubServiceBroker.Store.Delete(metadataKey); err != nil && err != store.ErrNotFound {
+			credhubServiceBroker.Logger.Error("delete-metadata-failed", err, lager.Data{"key": metadataKey})
+		}
+	}
+
+	if asyncAllowed {
+		spec.OperationData, err = credhubServiceBroker.startOperation(serviceDetails.ServiceID, instanceID, OperationProvision, credhubServiceBroker.audited(context, event, func(*audit.Event) error {
+			return write()
+		}))
+		if err != nil {
+			discardMetadata()
+		}
+		spec.IsAsync = err == nil
+		return spec, err
+	}
+
+	if err = write(); err != nil {
+		discardMetadata()
+		return spec, err
+	}
+
+	credhubServiceBroker.Logger.Info("successfully stored credentials for instanceID " + instanceID)
 	return spec, nil
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	serviceInstanceKey := constructKey(details.ServiceID, instanceID, CredentialsID)
-
-	err := credhubServiceBroker.CredHubClient.Delete(serviceInstanceKey)
+func (credhubServiceBroker *CredhubServiceBroker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (spec brokerapi.DeprovisionServiceSpec, err error) {
+	event := audit.Event{
+		Operation:   OperationDeprovision,
+		ServiceID:   details.ServiceID,
+		PlanID:      details.PlanID,
+		InstanceID:  instanceID,
+		CredHubPath: constructKey(details.ServiceID, instanceID, ""),
+	}
+	defer func() {
+		if spec.IsAsync {
+			event.Outcome = audit.OutcomeAccepted
+		}
+		err = unavailable(context, err)
+		credhubServiceBroker.audit(context, event, err)
+	}()
+
+	_, exists, err := credhubServiceBroker.readInstance(details.ServiceID, instanceID)
 	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+		return spec, err
+	}
+
+	if !exists {
+		record, found, err := credhubServiceBroker.readOperation(details.ServiceID, instanceID)
+		if err != nil {
+			return spec, err
+		}
+		if !found {
+			return spec, brokerapi.ErrInstanceDoesNotExist
+		}
+		if record.Type == OperationDeprovision && credhubServiceBroker.running(details.ServiceID, instanceID, record) && asyncAllowed {
+			spec.IsAsync = true
+			spec.OperationData = encodeOperationData(record.Type, details.ServiceID, record.ID)
+			return spec, nil
+		}
+		// only the record of an earlier operation is left, delete it below
+	}
+
+	work := func(event *audit.Event) error {
+		actors, err := credhubServiceBroker.deleteInstance(details.ServiceID, instanceID)
+		if err != nil {
+			return err
+		}
+		if len(actors) > 0 {
+			event.ActorsRemoved = actors
+		}
+		return nil
+	}
+
+	if asyncAllowed {
+		spec.OperationData, err = credhubServiceBroker.startOperation(details.ServiceID, instanceID, OperationDeprovision, credhubServiceBroker.audited(context, event, work))
+		spec.IsAsync = err == nil
+		return spec, err
 	}
-	// TODO do we need to delete or check for orphaned actor entries?
 
-	credhubServiceBroker.Logger.Info("successfully deprovisioned service instance key" + serviceInstanceKey)
-	return brokerapi.DeprovisionServiceSpec{}, nil
+	if err = credhubServiceBroker.checkNoOperation(details.ServiceID, instanceID); err != nil {
+		return spec, err
+	}
+	if err = work(&event); err != nil {
+		return spec, err
+	}
+
+	operationKey := constructKey(details.ServiceID, instanceID, OperationID)
+	if err := credhubServiceBroker.Store.Delete(operationKey); err != nil && err != store.ErrNotFound {
+		return spec, err
+	}
+
+	credhubServiceBroker.Logger.Info("successfully deprovisioned service instance " + instanceID)
+	return spec, nil
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	if details.BindResource.AppGuid == "" {
-		return brokerapi.Binding{}, errors.New("No app-guid was provided in the binding request, you must have one")
+func (credhubServiceBroker *CredhubServiceBroker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (binding brokerapi.Binding, err error) {
+	event := audit.Event{
+		Operation:  OperationBind,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+	}
+	auditContext(&event, details.RawContext)
+	defer func() {
+		err = unavailable(context, err)
+		credhubServiceBroker.audit(context, event, err)
+	}()
+
+	if reservedBindingID(bindingID) {
+		return brokerapi.Binding{}, brokerapi.NewFailureResponse(
+			fmt.Errorf("binding ID %q is reserved", bindingID),
+			http.StatusBadRequest, "reserved-binding-id",
+		)
+	}
+
+	plan, err := credhubServiceBroker.findPlan(details.ServiceID, details.PlanID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	platform, err := parsePlatformContext(details.RawContext)
+	if err != nil {
+		return brokerapi.Binding{}, err
 	}
 
-	// TODO do we need some kind of transcation for this?
-	actor := fmt.Sprintf("mtls-app:%s", details.BindResource.AppGuid)
 	bindingKey := constructKey(details.ServiceID, instanceID, bindingID)
-	_, err := credhubServiceBroker.CredHubClient.SetValue(bindingKey, values.Value(actor), credhub.Mode("no-overwrite"))
+	instanceKey := constructKey(details.ServiceID, instanceID, CredentialsID)
+	key := instanceKey
+	if plan.BindingCredentials != "" {
+		key = bindingCredentialsKey(details.ServiceID, instanceID, bindingID)
+	}
+
+	var actor, appGUID string
+	if platform.Platform == PlatformKubernetes {
+		actor, key, err = credhubServiceBroker.kubernetesBinding(platform, details.ServiceID, instanceID, bindingID)
+	} else {
+		actor, err = bindingActor(plan, details)
+		appGUID = strings.TrimPrefix(actor, "mtls-app:")
+		if appGUID == actor {
+			appGUID = ""
+		}
+	}
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
 
-	additionalPermissions := []permissions.Permission{
-		{
-			Actor:      actor,
-			Operations: []string{"read"},
-		},
+	// operations and client_id are the broker's own parameters, not the plan's
+	planParameters, err := withoutParameters(details.RawParameters, OperationsParameter, ClientIDParameter)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if err := validateParameters(plan, bindingCreateSchema, planParameters); err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	var operations []string
+	if actor != "" {
+		operations, err = operationsParameter(plan, details.RawParameters)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+	}
+
+	instance, exists, err := credhubServiceBroker.readInstance(details.ServiceID, instanceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if !exists {
+		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	if err := checkSharing(plan, instance, platform); err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	logger := credhubServiceBroker.Logger.Session("bind", lager.Data{"binding-key": bindingKey})
+
+	record := bindingRecord{
+		Actor:            actor,
+		AppGUID:          appGUID,
+		ServiceID:        details.ServiceID,
+		PlanID:           details.PlanID,
+		Platform:         platform.Platform,
+		OrganizationGUID: platform.OrganizationGUID,
+		SpaceGUID:        platform.SpaceGUID,
+		ParametersHash:   parametersHash(details.RawParameters),
+		CredentialName:   key,
+		Operations:       operations,
+		CreatedAt:        timestamp(),
+	}
+
+	existingBinding := func() (brokerapi.Binding, error) {
+		existing, err := readBinding(credhubServiceBroker.Store, bindingKey)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if !existing.matches(record) {
+			return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+		}
+		// a bind that stopped after storing its record, or whose rollback
+		// failed, left the record without the access it stands for
+		if err := credhubServiceBroker.completeBinding(plan, details.ServiceID, instanceID, existing); err != nil {
+			return brokerapi.Binding{}, err
+		}
+		markAlreadyExists(context)
+		event.Outcome = audit.OutcomeUnchanged
+		event.CredHubPath = existing.credentialName(instanceKey)
+		return credhubServiceBroker.bindingResponse(existing, existing.credentialName(instanceKey))
+	}
+
+	binding, err = existingBinding()
+	if err != store.ErrNotFound {
+		return binding, err
 	}
-	key := constructKey(details.ServiceID, instanceID, CredentialsID)
-	_, err = credhubServiceBroker.CredHubClient.AddPermissions(key, additionalPermissions)
+
+	// a concurrent bind may store its record between the read above and this
+	// write, its record is only ever deleted by the request that created it
+	created, err := credhubServiceBroker.createRecord(bindingKey, record)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
+	if !created {
+		return existingBinding()
+	}
+
+	event.CredHubPath = key
+
+	transaction := newTransaction(logger)
+	transaction.add("store-binding-record",
+		func() error {
+			// already stored above
+			return nil
+		},
+		func() error {
+			return credhubServiceBroker.Store.Delete(bindingKey)
+		},
+	)
+	if key != instanceKey {
+		transaction.add("write-binding-credentials",
+			func() error {
+				return credhubServiceBroker.writeBindingCredentials(plan, details.ServiceID, instanceID, key)
+			},
+			func() error {
+				return credhubServiceBroker.Store.Delete(key)
+			},
+		)
+	}
+	if actor != "" {
+		transaction.add("grant-permission",
+			func() error {
+				additionalPermissions := []permissions.Permission{
+					{
+						Actor:      actor,
+						Operations: operations,
+					},
+				}
+				return credhubServiceBroker.Store.AddPermissions(key, additionalPermissions)
+			},
+			func() error {
+				return credhubServiceBroker.Store.DeletePermissions(key, actor)
+			},
+		)
+	}
+
+	if err := transaction.run(); err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if actor != "" {
+		event.ActorsAdded = []string{actor}
+	}
 
 	credhubServiceBroker.Logger.Info("successfully bound service instance for key " + bindingKey)
-	return brokerapi.Binding{Credentials: map[string]string{"credhub-ref": key}}, nil
+	return credhubServiceBroker.bindingResponse(record, key)
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+func (credhubServiceBroker *CredhubServiceBroker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) (err error) {
+	event := audit.Event{
+		Operation:  OperationUnbind,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		InstanceID: instanceID,
+		BindingID:  bindingID,
+	}
+	defer func() {
+		err = unavailable(context, err)
+		credhubServiceBroker.audit(context, event, err)
+	}()
+
+	// the instance's own records are never bindings
+	if reservedBindingID(bindingID) {
+		return brokerapi.ErrBindingDoesNotExist
+	}
+
 	bindingKey := constructKey(details.ServiceID, instanceID, bindingID)
+	logger := credhubServiceBroker.Logger.Session("unbind", lager.Data{"binding-key": bindingKey})
 
-	// TODO transaction?
 	credhubServiceBroker.Logger.Info("retrieving service binding actor for key " + bindingKey)
-	actor, err := credhubServiceBroker.CredHubClient.GetLatestValue(bindingKey)
-	if err != nil {
-		return err
+	binding, err := readBinding(credhubServiceBroker.Store, bindingKey)
+	if err == store.ErrNotFound {
+		return brokerapi.ErrBindingDoesNotExist
 	}
-
-	serviceInstanceKey := constructKey(details.ServiceID, instanceID, CredentialsID)
-	credhubServiceBroker.Logger.Info("deleting permissions for actor and key", lager.Data{"actor": string(actor.Value), "key": serviceInstanceKey})
-	credhubServiceBroker.deletePermissions(serviceInstanceKey, string(actor.Value))
 	if err != nil {
 		return err
 	}
+	actor := binding.Actor
+
+	instanceKey := constructKey(details.ServiceID, instanceID, CredentialsID)
+	key := binding.credentialName(instanceKey)
+	revoked := false
+
+	event.Platform = binding.Platform
+	event.OrganizationGUID = binding.OrganizationGUID
+	event.SpaceGUID = binding.SpaceGUID
+	event.CredHubPath = key
+
+	transaction := newTransaction(logger)
+	if key != instanceKey {
+		// deleting the binding's own credential removes its permissions too
+		transaction.add("delete-binding-credentials",
+			func() error {
+				credhubServiceBroker.Logger.Info("deleting binding credentials", lager.Data{"key": key})
+				err := credhubServiceBroker.Store.Delete(key)
+				if err == store.ErrNotFound {
+					return nil
+				}
+				return err
+			},
+			nil,
+		)
+	} else if actor != "" {
+		transaction.add("revoke-permission",
+			func() error {
+				credhubServiceBroker.Logger.Info("deleting permissions for actor and key", lager.Data{"actor": actor, "key": key})
+				err := credhubServiceBroker.Store.DeletePermissions(key, actor)
+				if err == store.ErrNotFound {
+					// already revoked by an earlier attempt
+					return nil
+				}
+				revoked = err == nil
+				return err
+			},
+			func() error {
+				if !revoked {
+					return nil
+				}
+				return credhubServiceBroker.Store.AddPermissions(key, []permissions.Permission{
+					{
+						Actor:      actor,
+						Operations: binding.operations(),
+					},
+				})
+			},
+		)
+		transaction.add("regrant-remaining-operations",
+			func() error {
+				return credhubServiceBroker.regrantOperations(details.ServiceID, instanceID, bindingID, key, actor)
+			},
+			nil,
+		)
+	}
+	transaction.add("delete-binding-actor",
+		func() error {
+			credhubServiceBroker.Logger.Info("deleting binding for key", lager.Data{"key": bindingKey})
+			err := credhubServiceBroker.Store.Delete(bindingKey)
+			if err == store.ErrNotFound {
+				// already deleted by a concurrent or earlier unbind
+				return nil
+			}
+			return err
+		},
+		nil,
+	)
 
-	credhubServiceBroker.Logger.Info("deleting binding for key", lager.Data{"key": bindingKey})
-	credhubServiceBroker.CredHubClient.Delete(bindingKey)
-	if err != nil {
+	if err := transaction.run(); err != nil {
 		return err
 	}
-
+	if actor != "" {
+		event.ActorsRemoved = []string{actor}
+	}
 	return nil
 }
 
-// LastOperation ...
+// LastOperation reports the state of an operation started with IsAsync.
 func (credhubServiceBroker *CredhubServiceBroker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
-	return brokerapi.LastOperation{}, nil
+	operation, err := credhubServiceBroker.lastOperation(instanceID, operationData)
+	return operation, unavailable(context, err)
 }
 
 func (credhubServiceBroker *CredhubServiceBroker) Update(context context.Context, instanceID string, serviceDetails brokerapi.UpdateDetails, asyncAllowed bool) (spec brokerapi.UpdateServiceSpec, err error) {
-	err = credhubServiceBroker.setJSON(serviceDetails.RawParameters, instanceID, serviceDetails.ServiceID)
+	event := audit.Event{
+		Operation:      OperationUpdate,
+		ServiceID:      serviceDetails.ServiceID,
+		PlanID:         serviceDetails.PlanID,
+		PreviousPlanID: serviceDetails.PreviousValues.PlanID,
+		InstanceID:     instanceID,
+		CredHubPath:    constructKey(serviceDetails.ServiceID, instanceID, CredentialsID),
+	}
+	auditContext(&event, serviceDetails.RawContext)
+	defer func() {
+		if spec.IsAsync {
+			event.Outcome = audit.OutcomeAccepted
+		}
+		err = unavailable(context, err)
+		credhubServiceBroker.audit(context, event, err)
+	}()
+
+	plan, err := credhubServiceBroker.findPlan(serviceDetails.ServiceID, serviceDetails.PlanID)
+	if err != nil {
+		return spec, err
+	}
 
+	_, exists, err := credhubServiceBroker.readInstance(serviceDetails.ServiceID, instanceID)
 	if err != nil {
 		return spec, err
 	}
+	if !exists {
+		return spec, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	planChanged := serviceDetails.PreviousValues.PlanID != "" && serviceDetails.PreviousValues.PlanID != serviceDetails.PlanID
+	if planChanged {
+		previousPlan, err := credhubServiceBroker.findPlan(serviceDetails.ServiceID, serviceDetails.PreviousValues.PlanID)
+		if err != nil {
+			return spec, err
+		}
+		// CredHub does not allow the type of an existing credential to change
+		if previousPlan.Generate != plan.Generate {
+			return spec, brokerapi.ErrPlanChangeNotSupported
+		}
+	}
+
+	// credentials are only written when the update has parameters, changing
+	// between plans alone keeps their value
+	var write func() error
+	if len(bytes.TrimSpace(serviceDetails.RawParameters)) > 0 {
+		write, err = credhubServiceBroker.prepareUpdate(plan, instanceID, serviceDetails)
+		if err != nil {
+			return spec, err
+		}
+	}
+
+	changePlan := func() error {
+		return credhubServiceBroker.updateMetadata(serviceDetails.ServiceID, instanceID, func(metadata *instanceMetadata) {
+			metadata.PlanID = serviceDetails.PlanID
+		})
+	}
+
+	switch {
+	case write == nil && !planChanged:
+		event.Outcome = audit.OutcomeUnchanged
+		return spec, nil
+	case write == nil:
+		write = changePlan
+	case planChanged:
+		prepared := write
+		write = func() error {
+			if err := prepared(); err != nil {
+				return err
+			}
+			return changePlan()
+		}
+	}
+
+	if asyncAllowed {
+		spec.OperationData, err = credhubServiceBroker.startOperation(serviceDetails.ServiceID, instanceID, OperationUpdate, credhubServiceBroker.audited(context, event, func(*audit.Event) error {
+			return write()
+		}))
+		spec.IsAsync = err == nil
+		return spec, err
+	}
 
-	credhubServiceBroker.Logger.Info("successfully updated user-provided credentials for instance " + instanceID)
+	if err = credhubServiceBroker.checkNoOperation(serviceDetails.ServiceID, instanceID); err != nil {
+		return spec, err
+	}
+	if err = write(); err != nil {
+		return spec, err
+	}
+
+	credhubServiceBroker.Logger.Info("successfully updated credentials for instance " + instanceID)
 	return spec, nil
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) plans() map[string]*brokerapi.ServicePlan {
-	plans := map[string]*brokerapi.ServicePlan{}
+func (credhubServiceBroker *CredhubServiceBroker) catalog() *Catalog {
+	if credhubServiceBroker.Catalog == nil {
+		return DefaultCatalog()
+	}
+	return credhubServiceBroker.Catalog
+}
 
-	plans[PlanNameDefault] = &brokerapi.ServicePlan{
-		ID:          PlanNameDefault,
-		Name:        PlanNameDefault,
-		Description: "Stores configuration parameters securely in CredHub",
-		Metadata: &brokerapi.ServicePlanMetadata{
-			Bullets: []string{
-				"Stores configuration parameters securely in CredHub",
-			},
-			DisplayName: PlanNameDefault,
+func (credhubServiceBroker *CredhubServiceBroker) findPlan(serviceID, planID string) (Plan, error) {
+	_, plan, ok := credhubServiceBroker.catalog().FindPlan(serviceID, planID)
+	if !ok {
+		return Plan{}, brokerapi.NewFailureResponse(
+			fmt.Errorf("plan %q of service %q is not in the catalog", planID, serviceID),
+			http.StatusBadRequest, "unknown-plan",
+		)
+	}
+	return plan, nil
+}
+
+// completeBinding makes the changes of a stored binding again. Each is
+// idempotent, so a binding that is already complete is left as it was.
+func (credhubServiceBroker *CredhubServiceBroker) completeBinding(plan Plan, serviceID, instanceID string, binding bindingRecord) error {
+	instanceKey := constructKey(serviceID, instanceID, CredentialsID)
+	key := binding.credentialName(instanceKey)
+
+	if key != instanceKey {
+		_, err := credhubServiceBroker.Store.GetLatestVersion(key)
+		if err == store.ErrNotFound {
+			err = credhubServiceBroker.writeBindingCredentials(plan, serviceID, instanceID, key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if binding.Actor == "" {
+		return nil
+	}
+
+	return credhubServiceBroker.Store.AddPermissions(key, []permissions.Permission{
+		{
+			Actor:      binding.Actor,
+			Operations: binding.operations(),
 		},
+	})
+}
+
+// bindingResponse returns the credentials of a binding in the form its
+// platform expects.
+func (credhubServiceBroker *CredhubServiceBroker) bindingResponse(binding bindingRecord, key string) (brokerapi.Binding, error) {
+	switch {
+	case binding.Platform == PlatformKubernetes:
+		return credhubServiceBroker.kubernetesCredentials(key)
+	case binding.Actor == "":
+		return credhubServiceBroker.inlineCredentials(key)
 	}
 
-	return plans
+	return credhubRef(key), nil
+}
+
+func credhubRef(key string) brokerapi.Binding {
+	return brokerapi.Binding{Credentials: map[string]string{"credhub-ref": key}}
 }
 
 func constructKey(serviceID, instanceID, suffixID string) string {
 	return fmt.Sprintf("/c/%s/%s/%s/%s", BrokerID, serviceID, instanceID, suffixID)
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) setJSON(rawParameters json.RawMessage, instanceID string, serviceID string) (err error) {
-	var credentials map[string]interface{}
-	err = json.Unmarshal(rawParameters, &credentials)
-	if err != nil {
-		return brokerapi.ErrRawParamsInvalid
+// prepareCredentials validates the parameters for a plan and returns the
+// write that stores the instance's credentials, so invalid parameters are
+// rejected before any asynchronous work starts.
+func (credhubServiceBroker *CredhubServiceBroker) prepareCredentials(plan Plan, rawParameters json.RawMessage, key string) (func() error, error) {
+	if plan.Generate != "" {
+		options, err := generateOptions(plan, plan.Generate, rawParameters)
+		if err != nil {
+			return nil, err
+		}
+
+		return func() error {
+			return credhubServiceBroker.generateCredential(key, options, credhub.Overwrite)
+		}, nil
 	}
 
-	key := constructKey(serviceID, instanceID, CredentialsID)
-	_, err = credhubServiceBroker.CredHubClient.SetJSON(key, values.JSON(credentials), credhub.Mode("overwrite"))
-
+	credType, value, err := parseCredentials(rawParameters)
 	if err != nil {
-		credhubServiceBroker.Logger.Error("unable to store user-provided credentials to credhub ", err, map[string]interface{}{"key": key})
-		return brokerapi.NewFailureResponse(err, http.StatusInternalServerError, "unable to store the user-provided credentials")
+		return nil, err
 	}
 
-	return nil
+	return func() error {
+		return credhubServiceBroker.setCredential(key, credType, value)
+	}, nil
 }
 
-func (credhubServiceBroker *CredhubServiceBroker) deletePermissions(credName string, actor string) error {
-	query := url.Values{}
-	query.Set("credential_name", credName)
-	query.Set("actor", actor)
+// deleteInstance deletes the instance's credentials along with any binding
+// records left under it, and returns the actors of those bindings. CredHub
+// removes permissions with the credential.
+func (credhubServiceBroker *CredhubServiceBroker) deleteInstance(serviceID, instanceID string) ([]string, error) {
+	instancePath := constructKey(serviceID, instanceID, "")
+	operationKey := constructKey(serviceID, instanceID, OperationID)
 
-	_, err := credhubServiceBroker.CredHubClient.Request(http.MethodDelete, "/api/v1/permissions", query, nil)
+	results, err := credhubServiceBroker.Store.FindByPath(instancePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	// bindings may keep their credentials outside the instance's path
+	names := []string{}
+	actors := []string{}
+	for _, credential := range results.Credentials {
+		names = append(names, credential.Name)
+		leaf := strings.TrimPrefix(credential.Name, instancePath)
+		if strings.Contains(leaf, "/") || reservedBindingID(leaf) {
+			continue
+		}
+
+		binding, err := readBinding(credhubServiceBroker.Store, credential.Name)
+		if err != nil {
+			continue
+		}
+		if binding.Actor != "" {
+			actors = append(actors, binding.Actor)
+		}
+		if binding.CredentialName == "" || strings.HasPrefix(binding.CredentialName, instancePath) {
+			continue
+		}
+		names = append([]string{binding.CredentialName}, names...)
+	}
+
+	for _, name := range names {
+		if name == operationKey {
+			continue
+		}
+
+		credhubServiceBroker.Logger.Info("deleting credential", lager.Data{"key": name})
+		if err := credhubServiceBroker.Store.Delete(name); err != nil && err != store.ErrNotFound {
+			return actors, err
+		}
+	}
+
+	return actors, nil
 }
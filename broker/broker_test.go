@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func newTestBroker(credStore store.Store) *CredhubServiceBroker {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	return &CredhubServiceBroker{Store: credStore, Catalog: DefaultCatalog(), Logger: logger}
+}
+
+func provisionDetails(planID, parameters string) brokerapi.ProvisionDetails {
+	return brokerapi.ProvisionDetails{
+		ServiceID:        ServiceID,
+		PlanID:           planID,
+		OrganizationGUID: "org-guid",
+		SpaceGUID:        "space-guid",
+		RawParameters:    json.RawMessage(parameters),
+	}
+}
+
+// blockingStore holds up writes of instance credentials until release is
+// closed, so a test can act while an operation is in progress.
+type blockingStore struct {
+	store.Store
+	release chan struct{}
+}
+
+func (blockingStore *blockingStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	if strings.HasSuffix(name, "/"+CredentialsID) {
+		<-blockingStore.release
+	}
+	return blockingStore.Store.SetJSON(name, value, mode)
+}
+
+func failureStatus(t *testing.T, err error) int {
+	t.Helper()
+	failure, ok := err.(*brokerapi.FailureResponse)
+	if !ok {
+		t.Fatalf("expected a failure response, got %#v", err)
+	}
+	return failure.ValidatedStatusCode(nil)
+}
+
+func TestProvisionStoresCredentials(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+
+	_, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := credStore.GetLatestJSON(constructKey(ServiceID, "instance", CredentialsID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "secret" {
+		t.Errorf("expected the provided credentials, got %v", cred.Value)
+	}
+}
@@ -0,0 +1,260 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ablease/credhub-broker/schema"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// Catalog is the set of services and plans advertised by the broker. It is
+// read from a JSON file so each foundation can set its own IDs, names and
+// metadata.
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+type Service struct {
+	brokerapi.Service
+	Plans []Plan `json:"plans"`
+}
+
+type Plan struct {
+	brokerapi.ServicePlan
+
+	// Generate is the type of credential CredHub generates for instances of
+	// this plan. When empty, instances store the user-provided parameters.
+	Generate string `json:"generate,omitempty"`
+
+	// BindingCredentials gives each binding a credential of its own instead
+	// of access to the instance's. It is BindingCredentialsCopy or
+	// BindingCredentialsGenerate, and empty to share the instance's.
+	BindingCredentials string `json:"binding_credentials,omitempty"`
+
+	// BindingTemplate describes the credential generated for each binding
+	// when BindingCredentials is BindingCredentialsGenerate.
+	BindingTemplate *BindingTemplate `json:"binding_template,omitempty"`
+
+	// AllowedOperations are the CredHub operations a binding may ask for
+	// with the operations parameter. Bindings get read when it is empty.
+	AllowedOperations []string `json:"allowed_operations,omitempty"`
+
+	// InlineServiceKeys returns the credential values to bindings without an
+	// app, such as service keys, instead of granting a UAA client access.
+	InlineServiceKeys bool `json:"inline_service_keys,omitempty"`
+
+	// CertificateCA is the name of the CredHub CA that signs the certificates
+	// generated for this plan, which are self-signed when it is empty.
+	// CertificateIsCA generates CAs instead of leaf certificates. Users
+	// cannot choose either through parameters.
+	CertificateCA   string `json:"certificate_ca,omitempty"`
+	CertificateIsCA bool   `json:"certificate_is_ca,omitempty"`
+
+	// Sharing limits which bindings of an instance shared into other spaces
+	// are allowed. SharingOrganization keeps them to the owning org.
+	Sharing string `json:"sharing,omitempty"`
+
+	// compiledSchemas are the plan's parameter schemas, compiled once by
+	// Validate and keyed like planSchemas.
+	compiledSchemas map[string]*schema.Schema
+}
+
+type BindingTemplate struct {
+	Generate   string          `json:"generate"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+func LoadCatalog(path string) (*Catalog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	catalog := &Catalog{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(catalog); err != nil {
+		return nil, fmt.Errorf("unable to parse catalog %s: %s", path, err)
+	}
+
+	if err := catalog.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid catalog %s: %s", path, err)
+	}
+
+	return catalog, nil
+}
+
+// DefaultCatalog is used when no catalog file is configured.
+func DefaultCatalog() *Catalog {
+	shareable := true
+	return &Catalog{
+		Services: []Service{
+			{
+				Service: brokerapi.Service{
+					ID:            ServiceID,
+					Name:          ServiceID,
+					Description:   "Stores configuration parameters securely in CredHub",
+					Bindable:      true,
+					PlanUpdatable: true,
+					Metadata: &brokerapi.ServiceMetadata{
+						DisplayName:     "credhub-broker",
+						LongDescription: "Stores configuration parameters securely in CredHub",
+						Shareable:       &shareable,
+					},
+					Tags: []string{
+						"credhub",
+					},
+				},
+				Plans: []Plan{
+					{
+						ServicePlan: brokerapi.ServicePlan{
+							ID:          PlanNameDefault,
+							Name:        PlanNameDefault,
+							Description: "Stores configuration parameters securely in CredHub",
+							Metadata: &brokerapi.ServicePlanMetadata{
+								Bullets: []string{
+									"Stores configuration parameters securely in CredHub",
+								},
+								DisplayName: PlanNameDefault,
+							},
+						},
+					},
+					generatedPlan("password", "Generates a password in CredHub"),
+					generatedPlan("user", "Generates a username and password in CredHub"),
+					generatedPlan("rsa", "Generates an RSA key pair in CredHub"),
+					generatedPlan("ssh", "Generates an SSH key pair in CredHub"),
+					generatedPlan("certificate", "Generates a certificate and private key in CredHub"),
+				},
+			},
+		},
+	}
+}
+
+func generatedPlan(credType, description string) Plan {
+	return Plan{
+		ServicePlan: brokerapi.ServicePlan{
+			ID:          credType,
+			Name:        credType,
+			Description: description,
+			Metadata: &brokerapi.ServicePlanMetadata{
+				Bullets: []string{
+					description,
+					"The credential is never exposed to the requesting user",
+				},
+				DisplayName: credType,
+			},
+		},
+		Generate: credType,
+	}
+}
+
+func (catalog *Catalog) Validate() error {
+	if len(catalog.Services) == 0 {
+		return errors.New("at least one service is required")
+	}
+
+	serviceIDs := map[string]bool{}
+	serviceNames := map[string]bool{}
+	planIDs := map[string]bool{}
+
+	for s, service := range catalog.Services {
+		if service.ID == "" || service.Name == "" {
+			return errors.New("every service requires an id and a name")
+		}
+		if serviceIDs[service.ID] {
+			return fmt.Errorf("duplicate service id %q", service.ID)
+		}
+		if serviceNames[service.Name] {
+			return fmt.Errorf("duplicate service name %q", service.Name)
+		}
+		serviceIDs[service.ID] = true
+		serviceNames[service.Name] = true
+
+		if service.Description == "" {
+			return fmt.Errorf("service %q requires a description", service.Name)
+		}
+		if len(service.Plans) == 0 {
+			return fmt.Errorf("service %q requires at least one plan", service.Name)
+		}
+
+		planNames := map[string]bool{}
+		for p, plan := range service.Plans {
+			if plan.ID == "" || plan.Name == "" {
+				return fmt.Errorf("every plan of service %q requires an id and a name", service.Name)
+			}
+			if planIDs[plan.ID] {
+				return fmt.Errorf("duplicate plan id %q", plan.ID)
+			}
+			if planNames[plan.Name] {
+				return fmt.Errorf("duplicate plan name %q in service %q", plan.Name, service.Name)
+			}
+			planIDs[plan.ID] = true
+			planNames[plan.Name] = true
+
+			if plan.Description == "" {
+				return fmt.Errorf("plan %q of service %q requires a description", plan.Name, service.Name)
+			}
+			if plan.Generate != "" && !generatedCredentialTypes[plan.Generate] {
+				return fmt.Errorf("plan %q of service %q cannot generate credentials of type %q", plan.Name, service.Name, plan.Generate)
+			}
+			if err := validateCertificateAuthority(plan); err != nil {
+				return fmt.Errorf("plan %q of service %q %s", plan.Name, service.Name, err)
+			}
+			if err := validateBindingCredentials(plan); err != nil {
+				return fmt.Errorf("plan %q of service %q %s", plan.Name, service.Name, err)
+			}
+			if err := validateAllowedOperations(plan); err != nil {
+				return fmt.Errorf("plan %q of service %q %s", plan.Name, service.Name, err)
+			}
+			if err := validateSharing(plan); err != nil {
+				return fmt.Errorf("plan %q of service %q %s", plan.Name, service.Name, err)
+			}
+
+			compiledSchemas := map[string]*schema.Schema{}
+			for name, raw := range planSchemas(plan) {
+				compiled, err := schema.Compile(raw)
+				if err != nil {
+					return fmt.Errorf("plan %q of service %q has an invalid %s schema: %s", plan.Name, service.Name, name, err)
+				}
+				compiledSchemas[name] = compiled
+			}
+			catalog.Services[s].Plans[p].compiledSchemas = compiledSchemas
+		}
+	}
+
+	return nil
+}
+
+// BrokerServices returns the catalog in the form served by the broker API.
+func (catalog *Catalog) BrokerServices() []brokerapi.Service {
+	services := []brokerapi.Service{}
+	for _, service := range catalog.Services {
+		brokerService := service.Service
+		brokerService.Plans = []brokerapi.ServicePlan{}
+		for _, plan := range service.Plans {
+			brokerService.Plans = append(brokerService.Plans, plan.ServicePlan)
+		}
+		services = append(services, brokerService)
+	}
+
+	return services
+}
+
+func (catalog *Catalog) FindPlan(serviceID, planID string) (Service, Plan, bool) {
+	for _, service := range catalog.Services {
+		if service.ID != serviceID {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return service, plan, true
+			}
+		}
+	}
+
+	return Service{}, Plan{}, false
+}
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeCatalog(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// catalogJSON returns a catalog of the given services, which are JSON objects
+// written with single quotes for readability.
+func catalogJSON(services ...string) string {
+	return strings.Replace(`{"services":[`+strings.Join(services, ",")+`]}`, "'", `"`, -1)
+}
+
+const (
+	catalogPlan    = `{'id':'plan-id','name':'plan','description':'A plan'}`
+	catalogService = `{'id':'service-id','name':'service','description':'A service','plans':[` + catalogPlan + `]}`
+)
+
+func TestLoadCatalog(t *testing.T) {
+	catalog, err := LoadCatalog(writeCatalog(t, catalogJSON(
+		catalogService,
+		`{'id':'other-service-id','name':'other','description':'Another service','plans':[
+			{'id':'password','name':'password','description':'Passwords','generate':'password','allowed_operations':['read','write']},
+			{'id':'copy','name':'copy','description':'Copies','binding_credentials':'copy','inline_service_keys':true,
+			 'schemas':{'service_instance':{'create':{'parameters':{'type':'object','required':['password']}}}}}
+		]}`,
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, plan, found := catalog.FindPlan("other-service-id", "copy")
+	if !found {
+		t.Fatal("expected the copy plan to be found")
+	}
+	if service.Name != "other" || plan.BindingCredentials != BindingCredentialsCopy || !plan.InlineServiceKeys {
+		t.Errorf("expected the plan's settings to be read, got %+v", plan)
+	}
+	if plan.compiledSchemas[instanceCreateSchema] == nil {
+		t.Error("expected the plan's create schema to be compiled when the catalog is loaded")
+	}
+	if err := validateParameters(plan, instanceCreateSchema, json.RawMessage(`{}`)); err == nil || failureStatus(t, err) != http.StatusBadRequest {
+		t.Errorf("expected parameters without a password to be rejected, got %v", err)
+	}
+	if err := validateParameters(plan, instanceUpdateSchema, json.RawMessage(`{}`)); err != nil {
+		t.Errorf("expected a plan without an update schema to accept any parameters, got %s", err)
+	}
+	if _, _, found := catalog.FindPlan("service-id", "copy"); found {
+		t.Error("expected plans to be found within their own service only")
+	}
+
+	if _, err := LoadCatalog(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing file to be rejected")
+	}
+}
+
+func TestLoadCatalogRejectsInvalidCatalogs(t *testing.T) {
+	for _, test := range []struct {
+		name, contents, message string
+	}{
+		{"not JSON", `services:`, "unable to parse"},
+		{"unknown catalog field", `{"services":[],"plans":[]}`, "unknown field"},
+		{"unknown service field", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plan':[],'plans':[` + catalogPlan + `]}`), "unknown field"},
+		{"unknown plan field", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan','generated':'password'}]}`), "unknown field"},
+		{"no services", catalogJSON(), "at least one service"},
+		{"service without an id", catalogJSON(`{'name':'service','description':'A service','plans':[` + catalogPlan + `]}`), "requires an id"},
+		{"service without a description", catalogJSON(`{'id':'service-id','name':'service','plans':[` + catalogPlan + `]}`), "requires a description"},
+		{"service without plans", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[]}`), "at least one plan"},
+		{"duplicate service id", catalogJSON(catalogService, `{'id':'service-id','name':'other','description':'A service','plans':[{'id':'other-plan-id','name':'plan','description':'A plan'}]}`), "duplicate service id"},
+		{"duplicate service name", catalogJSON(catalogService, `{'id':'other-service-id','name':'service','description':'A service','plans':[{'id':'other-plan-id','name':'plan','description':'A plan'}]}`), "duplicate service name"},
+		{"duplicate plan id across services", catalogJSON(catalogService, `{'id':'other-service-id','name':'other','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan'}]}`), "duplicate plan id"},
+		{"duplicate plan name", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[` + catalogPlan + `,{'id':'other-plan-id','name':'plan','description':'A plan'}]}`), "duplicate plan name"},
+		{"plan without a description", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan'}]}`), "requires a description"},
+		{"unknown generated type", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan','generate':'token'}]}`), "cannot generate"},
+		{"unknown binding credentials", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan','binding_credentials':'share'}]}`), "binding_credentials"},
+		{"unknown allowed operation", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan','allowed_operations':['execute']}]}`), "unknown operation"},
+		{"invalid schema", catalogJSON(`{'id':'service-id','name':'service','description':'A service','plans':[{'id':'plan-id','name':'plan','description':'A plan','schemas':{'service_binding':{'create':{'parameters':{'type':'list'}}}}}]}`), "invalid service_binding.create schema"},
+	} {
+		_, err := LoadCatalog(writeCatalog(t, test.contents))
+		if err == nil {
+			t.Errorf("%s: expected the catalog to be rejected", test.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%s: expected an error about %q, got %s", test.name, test.message, err)
+		}
+	}
+}
+
+func TestDefaultCatalogIsValid(t *testing.T) {
+	if err := DefaultCatalog().Validate(); err != nil {
+		t.Errorf("expected the default catalog to be valid, got %s", err)
+	}
+}
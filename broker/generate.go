@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const defaultKeyLength = 2048
+
+// generatedCredentialTypes are the credential types a plan can ask CredHub to
+// generate instead of storing user-provided JSON.
+var generatedCredentialTypes = map[string]bool{
+	"password":    true,
+	"user":        true,
+	"rsa":         true,
+	"ssh":         true,
+	"certificate": true,
+}
+
+type userParameters struct {
+	Username string `json:"username"`
+	generate.User
+}
+
+// certificateParameters are the certificate options a user may choose. The
+// CA that signs the certificate and whether it is a CA itself are only taken
+// from the plan, and key usages are left to CredHub.
+type certificateParameters struct {
+	CommonName       string   `json:"common_name,omitempty"`
+	AlternativeNames []string `json:"alternative_names,omitempty"`
+	Organization     string   `json:"organization,omitempty"`
+	OrganizationUnit string   `json:"organization_unit,omitempty"`
+	Locality         string   `json:"locality,omitempty"`
+	State            string   `json:"state,omitempty"`
+	Country          string   `json:"country,omitempty"`
+	Duration         int      `json:"duration,omitempty"`
+	KeyLength        int      `json:"key_length,omitempty"`
+}
+
+func validateCertificateAuthority(plan Plan) error {
+	if plan.CertificateCA == "" && !plan.CertificateIsCA {
+		return nil
+	}
+	if plan.Generate != "certificate" && (plan.BindingTemplate == nil || plan.BindingTemplate.Generate != "certificate") {
+		return errors.New("sets certificate_ca or certificate_is_ca but does not generate certificates")
+	}
+	return nil
+}
+
+// generateOptions maps provision parameters onto the generate options for
+// the credential type. Unknown parameters are rejected so typos do not
+// silently fall back to defaults.
+func generateOptions(plan Plan, credType string, rawParameters json.RawMessage) (interface{}, error) {
+	if len(rawParameters) == 0 {
+		rawParameters = json.RawMessage("{}")
+	}
+
+	decode := func(options interface{}) error {
+		decoder := json.NewDecoder(bytes.NewReader(rawParameters))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(options); err != nil {
+			return brokerapi.NewFailureResponse(
+				fmt.Errorf("invalid parameters for a generated %s credential: %s", credType, err),
+				http.StatusBadRequest, "invalid-generate-parameters",
+			)
+		}
+		return nil
+	}
+
+	switch credType {
+	case "password":
+		var options generate.Password
+		return options, decode(&options)
+	case "user":
+		var options userParameters
+		if err := decode(&options); err != nil {
+			return nil, err
+		}
+		options.User.Username = options.Username
+		return options.User, nil
+	case "rsa":
+		options := generate.RSA{KeyLength: defaultKeyLength}
+		return options, decode(&options)
+	case "ssh":
+		options := generate.SSH{KeyLength: defaultKeyLength}
+		return options, decode(&options)
+	case "certificate":
+		var parameters certificateParameters
+		if err := decode(&parameters); err != nil {
+			return nil, err
+		}
+		return generate.Certificate{
+			CommonName:       parameters.CommonName,
+			AlternativeNames: parameters.AlternativeNames,
+			Organization:     parameters.Organization,
+			OrganizationUnit: parameters.OrganizationUnit,
+			Locality:         parameters.Locality,
+			State:            parameters.State,
+			Country:          parameters.Country,
+			Duration:         parameters.Duration,
+			KeyLength:        parameters.KeyLength,
+			Ca:               plan.CertificateCA,
+			IsCA:             plan.CertificateIsCA,
+			SelfSign:         plan.CertificateCA == "",
+		}, nil
+	}
+
+	return nil, fmt.Errorf("credential type %q cannot be generated", credType)
+}
+
+func (credhubServiceBroker *CredhubServiceBroker) generateCredential(key string, options interface{}, mode credhub.Mode) (err error) {
+	var credType string
+	switch options := options.(type) {
+	case generate.Password:
+		credType = "password"
+		_, err = credhubServiceBroker.Store.GeneratePassword(key, options, mode)
+	case generate.User:
+		credType = "user"
+		_, err = credhubServiceBroker.Store.GenerateUser(key, options, mode)
+	case generate.RSA:
+		credType = "rsa"
+		_, err = credhubServiceBroker.Store.GenerateRSA(key, options, mode)
+	case generate.SSH:
+		credType = "ssh"
+		_, err = credhubServiceBroker.Store.GenerateSSH(key, options, mode)
+	case generate.Certificate:
+		credType = "certificate"
+		_, err = credhubServiceBroker.Store.GenerateCertificate(key, options, mode)
+	default:
+		return fmt.Errorf("unsupported generate options %T", options)
+	}
+
+	if err != nil {
+		credhubServiceBroker.Logger.Error("unable to generate credentials in credhub", err, map[string]interface{}{"key": key, "type": credType})
+		if err == store.ErrTypeModified {
+			return brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "credential-type-modified")
+		}
+		// left for the broker API methods to answer with a 503
+		if store.IsTransient(err) {
+			return err
+		}
+		return brokerapi.NewFailureResponse(err, http.StatusInternalServerError, "unable to generate the credentials")
+	}
+
+	return nil
+}
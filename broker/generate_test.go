@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+)
+
+func TestCertificateParametersCannotChooseTheCA(t *testing.T) {
+	for _, parameters := range []string{
+		`{"common_name":"x","ca":"/cf/diego-instance-identity-root-ca"}`,
+		`{"common_name":"x","is_ca":true}`,
+		`{"common_name":"x","self_sign":false}`,
+		`{"common_name":"x","key_usage":["key_cert_sign"]}`,
+		`{"common_name":"x","extended_key_usage":["server_auth"]}`,
+	} {
+		_, err := generateOptions(Plan{}, "certificate", json.RawMessage(parameters))
+		if status := failureStatus(t, err); status != http.StatusBadRequest {
+			t.Errorf("expected %d for %s, got %d", http.StatusBadRequest, parameters, status)
+		}
+	}
+}
+
+func TestCertificatesAreSelfSignedUnlessThePlanNamesACA(t *testing.T) {
+	options, err := generateOptions(Plan{}, "certificate", json.RawMessage(`{"common_name":"x","alternative_names":["x.example.com"],"duration":30}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := options.(generate.Certificate)
+	if !certificate.SelfSign || certificate.Ca != "" || certificate.IsCA {
+		t.Errorf("expected a self-signed leaf certificate, got %+v", certificate)
+	}
+	if certificate.CommonName != "x" || certificate.Duration != 30 || len(certificate.AlternativeNames) != 1 {
+		t.Errorf("expected the user's parameters, got %+v", certificate)
+	}
+
+	plan := Plan{Generate: "certificate", CertificateCA: "/services/ca", CertificateIsCA: true}
+	options, err = generateOptions(plan, "certificate", json.RawMessage(`{"common_name":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate = options.(generate.Certificate)
+	if certificate.SelfSign || certificate.Ca != "/services/ca" || !certificate.IsCA {
+		t.Errorf("expected a CA signed by the plan's CA, got %+v", certificate)
+	}
+}
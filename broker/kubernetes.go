@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	PlatformCloudFoundry = "cloudfoundry"
+	PlatformKubernetes   = "kubernetes"
+)
+
+// platformContext is the part of the OSB context object the broker uses to
+// tell platforms apart.
+type platformContext struct {
+	Platform         string `json:"platform"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	Namespace        string `json:"namespace,omitempty"`
+	ClusterID        string `json:"clusterid,omitempty"`
+}
+
+// KubernetesRule maps the cluster and namespace of a Kubernetes binding to
+// the CredHub actor granted access and the name of the binding's credential.
+// Cluster and Namespace are path.Match patterns, empty matches anything.
+// Actor and Path may refer to {cluster}, {namespace}, {service_id},
+// {instance_id} and {binding_id}. The binding record keeps the credential
+// name, which is how the reconciler finds a Path outside the instance's path.
+type KubernetesRule struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Actor     string `json:"actor"`
+	Path      string `json:"path,omitempty"`
+}
+
+func LoadKubernetesRules(path string) ([]KubernetesRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules := []KubernetesRule{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("kubernetes rule %d %s", i, err)
+		}
+	}
+
+	return rules, nil
+}
+
+func (rule KubernetesRule) validate() error {
+	for _, pattern := range []string{rule.Cluster, rule.Namespace} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("has an invalid pattern %q", pattern)
+		}
+	}
+	if rule.Actor == "" {
+		return errors.New("requires an actor")
+	}
+	if rule.Path != "" && !strings.Contains(rule.Path, "{binding_id}") {
+		return errors.New("requires a path that includes {binding_id}")
+	}
+
+	return nil
+}
+
+func (rule KubernetesRule) matches(context platformContext) bool {
+	return matchPattern(rule.Cluster, context.ClusterID) && matchPattern(rule.Namespace, context.Namespace)
+}
+
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
+
+func parsePlatformContext(rawContext json.RawMessage) (platformContext, error) {
+	context := platformContext{Platform: PlatformCloudFoundry}
+	if len(bytes.TrimSpace(rawContext)) == 0 {
+		return context, nil
+	}
+
+	if err := json.Unmarshal(rawContext, &context); err != nil {
+		return context, brokerapi.NewFailureResponse(errors.New("the context is not a valid JSON object"), http.StatusBadRequest, "invalid-context")
+	}
+
+	switch context.Platform {
+	case "":
+		context.Platform = PlatformCloudFoundry
+	case PlatformCloudFoundry:
+	case PlatformKubernetes:
+		if context.Namespace == "" {
+			return context, brokerapi.NewFailureResponse(errors.New("the kubernetes context requires a namespace"), http.StatusBadRequest, "invalid-context")
+		}
+	default:
+		return context, brokerapi.NewFailureResponse(fmt.Errorf("platform %q is not supported", context.Platform), http.StatusUnprocessableEntity, "unsupported-platform")
+	}
+
+	return context, nil
+}
+
+// kubernetesBinding returns the actor and credential name of a Kubernetes
+// binding from the first rule that matches its cluster and namespace.
+func (credhubServiceBroker *CredhubServiceBroker) kubernetesBinding(context platformContext, serviceID, instanceID, bindingID string) (string, string, error) {
+	for _, rule := range credhubServiceBroker.KubernetesRules {
+		if !rule.matches(context) {
+			continue
+		}
+
+		replacer := strings.NewReplacer(
+			"{cluster}", context.ClusterID,
+			"{namespace}", context.Namespace,
+			"{service_id}", serviceID,
+			"{instance_id}", instanceID,
+			"{binding_id}", bindingID,
+		)
+
+		key := bindingCredentialsKey(serviceID, instanceID, bindingID)
+		if rule.Path != "" {
+			key = replacer.Replace(rule.Path)
+		}
+
+		return replacer.Replace(rule.Actor), key, nil
+	}
+
+	return "", "", brokerapi.NewFailureResponse(
+		fmt.Errorf("no kubernetes rule allows bindings from namespace %q of cluster %q", context.Namespace, context.ClusterID),
+		http.StatusForbidden, "kubernetes-namespace-not-allowed",
+	)
+}
+
+// kubernetesCredentials returns the credential in the flat string map that
+// becomes the data of a Kubernetes secret, along with its CredHub reference.
+// Values that are not strings are JSON encoded.
+func (credhubServiceBroker *CredhubServiceBroker) kubernetesCredentials(key string) (brokerapi.Binding, error) {
+	binding, err := credhubServiceBroker.inlineCredentials(key)
+	if err != nil {
+		return binding, err
+	}
+
+	data := map[string]string{"credhub-ref": key}
+	for name, value := range binding.Credentials.(map[string]interface{}) {
+		if text, ok := value.(string); ok {
+			data[name] = text
+			continue
+		}
+
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		data[name] = string(encoded)
+	}
+
+	return brokerapi.Binding{Credentials: data}, nil
+}
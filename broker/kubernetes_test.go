@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func writeKubernetesRules(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "kubernetes-rules.json")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadKubernetesRules(t *testing.T) {
+	rules, err := LoadKubernetesRules(writeKubernetesRules(t, `[
+		{"cluster":"prod-*","namespace":"team-?","actor":"k8s:{cluster}:{namespace}","path":"/k8s/{namespace}/{binding_id}"},
+		{"actor":"k8s:default"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KubernetesRule{
+		{Cluster: "prod-*", Namespace: "team-?", Actor: "k8s:{cluster}:{namespace}", Path: "/k8s/{namespace}/{binding_id}"},
+		{Actor: "k8s:default"},
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Errorf("expected %+v, got %+v", expected, rules)
+	}
+
+	for _, test := range []struct {
+		name, contents string
+	}{
+		{"not a list", `{"actor":"k8s"}`},
+		{"unknown field", `[{"actor":"k8s","namespaces":"team-a"}]`},
+		{"invalid cluster pattern", `[{"cluster":"prod-[","actor":"k8s"}]`},
+		{"invalid namespace pattern", `[{"namespace":"team-\\","actor":"k8s"}]`},
+		{"no actor", `[{"namespace":"team-a"}]`},
+		{"path without the binding id", `[{"actor":"k8s","path":"/k8s/{namespace}"}]`},
+	} {
+		if _, err := LoadKubernetesRules(writeKubernetesRules(t, test.contents)); err == nil {
+			t.Errorf("%s: expected the rules to be rejected", test.name)
+		}
+	}
+
+	if _, err := LoadKubernetesRules(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected a missing file to be rejected")
+	}
+}
+
+func TestKubernetesBindingUsesTheFirstMatchingRule(t *testing.T) {
+	broker := newTestBroker(store.NewMemoryStore())
+	broker.KubernetesRules = []KubernetesRule{
+		{Cluster: "prod-*", Namespace: "team-?", Actor: "k8s:{cluster}:{namespace}", Path: "/k8s/{cluster}/{namespace}/{service_id}/{instance_id}/{binding_id}"},
+		{Namespace: "team-*", Actor: "k8s:team"},
+		{Cluster: "dev", Actor: "k8s:dev:{namespace}"},
+	}
+	defaultKey := bindingCredentialsKey(ServiceID, "instance", "binding")
+
+	for _, test := range []struct {
+		cluster, namespace string
+		actor, key         string
+	}{
+		{"prod-eu", "team-a", "k8s:prod-eu:team-a", "/k8s/prod-eu/team-a/" + ServiceID + "/instance/binding"},
+		{"prod-eu", "team-ab", "k8s:team", defaultKey},
+		{"staging", "team-a", "k8s:team", defaultKey},
+		{"dev", "other", "k8s:dev:other", defaultKey},
+	} {
+		context := platformContext{Platform: PlatformKubernetes, ClusterID: test.cluster, Namespace: test.namespace}
+		actor, key, err := broker.kubernetesBinding(context, ServiceID, "instance", "binding")
+		if err != nil {
+			t.Errorf("%s/%s: unexpected error %s", test.cluster, test.namespace, err)
+			continue
+		}
+		if actor != test.actor || key != test.key {
+			t.Errorf("%s/%s: expected %s at %s, got %s at %s", test.cluster, test.namespace, test.actor, test.key, actor, key)
+		}
+	}
+
+	_, _, err := broker.kubernetesBinding(platformContext{Platform: PlatformKubernetes, ClusterID: "staging", Namespace: "other"}, ServiceID, "instance", "binding")
+	if status := failureStatus(t, err); status != http.StatusForbidden {
+		t.Errorf("expected a namespace without a rule to answer 403, got %d", status)
+	}
+}
+
+func TestKubernetesBindReturnsAFlatStringMap(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	rules, err := LoadKubernetesRules(writeKubernetesRules(t, `[{"namespace":"team-*","actor":"k8s:{namespace}","path":"/k8s/{namespace}/{binding_id}"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker.KubernetesRules = rules
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret","port":5432,"tls":{"enabled":true}}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	binding, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(`{"platform":"kubernetes","namespace":"team-a","clusterid":"cluster"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"credhub-ref": "/k8s/team-a/binding",
+		"password":    "secret",
+		"port":        "5432",
+		"tls":         `{"enabled":true}`,
+	}
+	if !reflect.DeepEqual(binding.Credentials, expected) {
+		t.Errorf("expected %v, got %#v", expected, binding.Credentials)
+	}
+
+	perms, err := credStore.GetPermissions("/k8s/team-a/binding")
+	if err != nil || len(perms) != 1 || perms[0].Actor != "k8s:team-a" {
+		t.Errorf("expected k8s:team-a to be granted access, got %v and %v", perms, err)
+	}
+
+	_, err = broker.Bind(context.Background(), "instance", "other-binding", bindDetails(`{"platform":"kubernetes","namespace":"other"}`))
+	if status := failureStatus(t, err); status != http.StatusForbidden {
+		t.Errorf("expected a namespace without a rule to answer 403, got %d", status)
+	}
+	err = broker.Unbind(context.Background(), "instance", "other-binding", brokerapi.UnbindDetails{ServiceID: ServiceID, PlanID: PlanNameDefault})
+	if err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("expected the refused binding not to exist, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/ablease/credhub-broker/store"
+)
+
+const MetadataID = "metadata"
+
+// instanceMetadata is the broker's record of an instance, kept beside its
+// credentials. It is compared against repeated provision requests.
+type instanceMetadata struct {
+	ServiceID        string            `json:"service_id,omitempty"`
+	PlanID           string            `json:"plan_id,omitempty"`
+	OrganizationGUID string            `json:"organization_guid,omitempty"`
+	SpaceGUID        string            `json:"space_guid,omitempty"`
+	ParametersHash   string            `json:"parameters_hash,omitempty"`
+	CreatedAt        string            `json:"created_at,omitempty"`
+	LastRotated      map[string]string `json:"last_rotated,omitempty"`
+}
+
+func (metadata instanceMetadata) matches(other instanceMetadata) bool {
+	return metadata.ServiceID == other.ServiceID &&
+		metadata.PlanID == other.PlanID &&
+		metadata.OrganizationGUID == other.OrganizationGUID &&
+		metadata.SpaceGUID == other.SpaceGUID &&
+		metadata.ParametersHash == other.ParametersHash
+}
+
+// bindingRecord is stored at the binding key and identifies the actor that
+// was granted access to the instance's credentials.
+type bindingRecord struct {
+	Actor            string   `json:"actor"`
+	AppGUID          string   `json:"app_guid,omitempty"`
+	ServiceID        string   `json:"service_id,omitempty"`
+	PlanID           string   `json:"plan_id,omitempty"`
+	Platform         string   `json:"platform,omitempty"`
+	OrganizationGUID string   `json:"organization_guid,omitempty"`
+	SpaceGUID        string   `json:"space_guid,omitempty"`
+	ParametersHash   string   `json:"parameters_hash,omitempty"`
+	CredentialName   string   `json:"credential_name,omitempty"`
+	Operations       []string `json:"operations,omitempty"`
+	CreatedAt        string   `json:"created_at,omitempty"`
+}
+
+// credentialName returns the credential the binding can read, which is the
+// instance's own unless the binding was given one.
+func (binding bindingRecord) credentialName(instanceKey string) string {
+	if binding.CredentialName == "" {
+		return instanceKey
+	}
+	return binding.CredentialName
+}
+
+// operations are the operations granted to the binding, bindings recorded
+// before they could ask for more were granted read.
+func (binding bindingRecord) operations() []string {
+	if len(binding.Operations) == 0 {
+		return defaultOperations
+	}
+	return binding.Operations
+}
+
+// matches compares a stored binding with a new bind request. Bindings made
+// before records held anything but the actor are compared by actor alone.
+func (binding bindingRecord) matches(other bindingRecord) bool {
+	if binding.PlanID == "" {
+		return binding.Actor == other.Actor
+	}
+
+	return binding.Actor == other.Actor &&
+		binding.AppGUID == other.AppGUID &&
+		binding.ServiceID == other.ServiceID &&
+		binding.PlanID == other.PlanID &&
+		binding.ParametersHash == other.ParametersHash
+}
+
+// readInstance returns the metadata of an instance and whether the instance
+// exists. Instances created before metadata was recorded exist with empty
+// metadata.
+func (credhubServiceBroker *CredhubServiceBroker) readInstance(serviceID, instanceID string) (instanceMetadata, bool, error) {
+	var metadata instanceMetadata
+	err := credhubServiceBroker.readRecord(constructKey(serviceID, instanceID, MetadataID), &metadata)
+	if err == nil {
+		return metadata, true, nil
+	}
+	if err != store.ErrNotFound {
+		return metadata, false, err
+	}
+
+	_, err = credhubServiceBroker.Store.GetLatestVersion(constructKey(serviceID, instanceID, CredentialsID))
+	if err == store.ErrNotFound {
+		return metadata, false, nil
+	}
+	return metadata, err == nil, err
+}
+
+// updateMetadata applies change to the instance's metadata record, creating
+// the record for instances that predate it.
+func (credhubServiceBroker *CredhubServiceBroker) updateMetadata(serviceID, instanceID string, change func(*instanceMetadata)) error {
+	key := constructKey(serviceID, instanceID, MetadataID)
+
+	var metadata instanceMetadata
+	if err := credhubServiceBroker.readRecord(key, &metadata); err != nil && err != store.ErrNotFound {
+		return err
+	}
+
+	change(&metadata)
+	return credhubServiceBroker.writeRecord(key, metadata)
+}
+
+// readBinding reads a binding record. Older brokers stored only the actor as
+// a value credential.
+func readBinding(credStore store.Store, key string) (bindingRecord, error) {
+	var binding bindingRecord
+
+	cred, err := credStore.GetLatestVersion(key)
+	if err != nil {
+		return binding, err
+	}
+
+	if cred.Type == "value" {
+		actor, _ := cred.Value.(string)
+		binding.Actor = actor
+		binding.AppGUID = strings.TrimPrefix(actor, "mtls-app:")
+		return binding, nil
+	}
+
+	data, err := json.Marshal(cred.Value)
+	if err != nil {
+		return binding, err
+	}
+	err = json.Unmarshal(data, &binding)
+	return binding, err
+}
+
+// parametersHash identifies request parameters without storing them.
+// Parameters are re-encoded first so formatting and key order do not matter.
+func parametersHash(rawParameters json.RawMessage) string {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return ""
+	}
+
+	var parameters interface{}
+	data := []byte(rawParameters)
+	if err := json.Unmarshal(rawParameters, &parameters); err == nil {
+		data, _ = json.Marshal(parameters)
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
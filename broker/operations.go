@@ -0,0 +1,331 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	OperationID = "operation"
+
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+
+	// bindings are always made synchronously, they are only audited
+	OperationBind   = "bind"
+	OperationUnbind = "unbind"
+)
+
+var (
+	errShuttingDown = brokerapi.NewFailureResponse(
+		errors.New("the broker is shutting down, please retry"),
+		http.StatusServiceUnavailable, "shutting-down",
+	)
+
+	errConcurrentOperation = brokerapi.NewFailureResponseBuilder(
+		errors.New("another operation is in progress for this service instance"),
+		http.StatusUnprocessableEntity, "concurrent-operation",
+	).WithErrorKey("ConcurrencyError").Build()
+
+	// processID identifies this broker process as the owner of the
+	// operations it starts.
+	processID = store.NewID()
+
+	heartbeatInterval = 30 * time.Second
+	staleAfter        = 3 * heartbeatInterval
+)
+
+// operationRecord is the persisted state of an asynchronous operation. It is
+// kept at /c/<broker>/<service>/<instance>/operation and reported by
+// LastOperation.
+type operationRecord struct {
+	ID          string                       `json:"id"`
+	Type        string                       `json:"type"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description"`
+	Owner       string                       `json:"owner"`
+	StartedAt   string                       `json:"started_at"`
+	UpdatedAt   string                       `json:"updated_at"`
+}
+
+// startOperation records an in-progress operation and runs work in the
+// background, unless the instance already has one running. The returned
+// operation data is handed to the platform and comes back on every
+// LastOperation poll.
+func (credhubServiceBroker *CredhubServiceBroker) startOperation(serviceID, instanceID, operationType string, work func() error) (string, error) {
+	key := constructKey(serviceID, instanceID, OperationID)
+	logger := credhubServiceBroker.Logger.Session("operation", lager.Data{"key": key, "type": operationType})
+
+	record := operationRecord{
+		ID:          store.NewID(),
+		Type:        operationType,
+		State:       brokerapi.InProgress,
+		Description: operationType + " in progress",
+		Owner:       processID,
+		StartedAt:   timestamp(),
+		UpdatedAt:   timestamp(),
+	}
+
+	// tracking the operation before anything is written stops a second
+	// operation in this process from starting alongside it
+	credhubServiceBroker.operationsMutex.Lock()
+	if credhubServiceBroker.shuttingDown {
+		credhubServiceBroker.operationsMutex.Unlock()
+		return "", errShuttingDown
+	}
+	if _, tracked := credhubServiceBroker.runningOperations[key]; tracked {
+		credhubServiceBroker.operationsMutex.Unlock()
+		return "", errConcurrentOperation
+	}
+	if credhubServiceBroker.runningOperations == nil {
+		credhubServiceBroker.runningOperations = map[string]operationRecord{}
+	}
+	credhubServiceBroker.runningOperations[key] = record
+	credhubServiceBroker.jobs.Add(1)
+	credhubServiceBroker.operationsMutex.Unlock()
+
+	abandon := func(err error) (string, error) {
+		credhubServiceBroker.untrackOperation(key)
+		credhubServiceBroker.jobs.Done()
+		return "", err
+	}
+
+	if err := credhubServiceBroker.checkNoOperation(serviceID, instanceID); err != nil {
+		return abandon(err)
+	}
+
+	if err := credhubServiceBroker.writeRecord(key, record); err != nil {
+		logger.Error("record-operation-failed", err)
+		return abandon(err)
+	}
+
+	go func() {
+		defer credhubServiceBroker.jobs.Done()
+
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			credhubServiceBroker.heartbeat(key, record, done)
+			close(stopped)
+		}()
+
+		err := work()
+
+		// a heartbeat written after the final record would leave the
+		// operation in progress
+		close(done)
+		<-stopped
+
+		if !credhubServiceBroker.untrackOperation(key) {
+			// Shutdown already recorded the operation as interrupted
+			logger.Info("finished-after-checkpoint", lager.Data{"succeeded": err == nil})
+			return
+		}
+
+		if err == nil && operationType == OperationDeprovision {
+			if err := credhubServiceBroker.Store.Delete(key); err != nil && err != store.ErrNotFound {
+				logger.Error("delete-operation-failed", err)
+			}
+			logger.Info("succeeded")
+			return
+		}
+
+		record.UpdatedAt = timestamp()
+		if err != nil {
+			logger.Error("failed", err)
+			record.State = brokerapi.Failed
+			record.Description = fmt.Sprintf("%s failed: %s", operationType, err)
+		} else {
+			logger.Info("succeeded")
+			record.State = brokerapi.Succeeded
+			record.Description = operationType + " succeeded"
+		}
+
+		if err := credhubServiceBroker.writeRecord(key, record); err != nil {
+			logger.Error("record-operation-failed", err)
+		}
+	}()
+
+	return encodeOperationData(operationType, serviceID, record.ID), nil
+}
+
+// checkNoOperation rejects a change to an instance while an operation on it
+// is running, in this process or another one.
+func (credhubServiceBroker *CredhubServiceBroker) checkNoOperation(serviceID, instanceID string) error {
+	record, found, err := credhubServiceBroker.readOperation(serviceID, instanceID)
+	if err != nil {
+		return err
+	}
+	if found && credhubServiceBroker.running(serviceID, instanceID, record) {
+		return errConcurrentOperation
+	}
+	return nil
+}
+
+// untrackOperation reports whether the operation was still tracked, that is
+// whether Shutdown has not recorded it as interrupted.
+func (credhubServiceBroker *CredhubServiceBroker) untrackOperation(key string) bool {
+	credhubServiceBroker.operationsMutex.Lock()
+	defer credhubServiceBroker.operationsMutex.Unlock()
+
+	_, tracked := credhubServiceBroker.runningOperations[key]
+	delete(credhubServiceBroker.runningOperations, key)
+	return tracked
+}
+
+// tracking reports whether this process is working on the operation.
+func (credhubServiceBroker *CredhubServiceBroker) tracking(key, operationID string) bool {
+	credhubServiceBroker.operationsMutex.Lock()
+	defer credhubServiceBroker.operationsMutex.Unlock()
+
+	record, tracked := credhubServiceBroker.runningOperations[key]
+	return tracked && record.ID == operationID
+}
+
+// Shutdown stops new asynchronous operations from starting and waits for the
+// running ones until ctx is done. Operations still running then are recorded
+// as failed, so the platform can retry them against another broker process
+// instead of polling until they go stale.
+func (credhubServiceBroker *CredhubServiceBroker) Shutdown(ctx context.Context) error {
+	credhubServiceBroker.operationsMutex.Lock()
+	credhubServiceBroker.shuttingDown = true
+	credhubServiceBroker.operationsMutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		credhubServiceBroker.jobs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+	}
+
+	credhubServiceBroker.operationsMutex.Lock()
+	interrupted := credhubServiceBroker.runningOperations
+	credhubServiceBroker.runningOperations = map[string]operationRecord{}
+	credhubServiceBroker.operationsMutex.Unlock()
+
+	for key, record := range interrupted {
+		credhubServiceBroker.Logger.Info("checkpointing-operation", lager.Data{"key": key, "type": record.Type})
+		record.State = brokerapi.Failed
+		record.Description = fmt.Sprintf("%s was interrupted by a broker shutdown, please retry", record.Type)
+		record.UpdatedAt = timestamp()
+		if err := credhubServiceBroker.writeRecord(key, record); err != nil {
+			credhubServiceBroker.Logger.Error("record-operation-failed", err, lager.Data{"key": key})
+		}
+	}
+
+	return ctx.Err()
+}
+
+// readOperation returns the instance's latest operation record, if any.
+func (credhubServiceBroker *CredhubServiceBroker) readOperation(serviceID, instanceID string) (operationRecord, bool, error) {
+	var record operationRecord
+	err := credhubServiceBroker.readRecord(constructKey(serviceID, instanceID, OperationID), &record)
+	if err == store.ErrNotFound {
+		return record, false, nil
+	}
+	return record, err == nil, err
+}
+
+// running reports whether the operation is still being worked on, by this
+// process or by another one that is still alive. A record of this process
+// is only trusted while the process still tracks the operation.
+func (credhubServiceBroker *CredhubServiceBroker) running(serviceID, instanceID string, record operationRecord) bool {
+	if record.State != brokerapi.InProgress {
+		return false
+	}
+	if record.Owner == processID {
+		return credhubServiceBroker.tracking(constructKey(serviceID, instanceID, OperationID), record.ID)
+	}
+	return !isStale(record)
+}
+
+// heartbeat keeps UpdatedAt fresh while work is running so other broker
+// processes can tell a running operation from one whose owner died.
+func (credhubServiceBroker *CredhubServiceBroker) heartbeat(key string, record operationRecord, done <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !credhubServiceBroker.tracking(key, record.ID) {
+				return
+			}
+			record.UpdatedAt = timestamp()
+			if err := credhubServiceBroker.writeRecord(key, record); err != nil {
+				credhubServiceBroker.Logger.Error("operation-heartbeat-failed", err, lager.Data{"key": key})
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (credhubServiceBroker *CredhubServiceBroker) lastOperation(instanceID, operationData string) (brokerapi.LastOperation, error) {
+	_, serviceID, operationID, err := decodeOperationData(operationData)
+	if err != nil {
+		return brokerapi.LastOperation{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-operation-data")
+	}
+
+	key := constructKey(serviceID, instanceID, OperationID)
+	var record operationRecord
+	err = credhubServiceBroker.readRecord(key, &record)
+	if err == store.ErrNotFound {
+		// a finished deprovision removes its record along with the instance
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		return brokerapi.LastOperation{}, err
+	}
+
+	if record.ID != operationID {
+		return brokerapi.LastOperation{
+			State:       brokerapi.Failed,
+			Description: "the operation was superseded by a later operation",
+		}, nil
+	}
+
+	if record.State == brokerapi.InProgress && !credhubServiceBroker.running(serviceID, instanceID, record) {
+		record.State = brokerapi.Failed
+		record.Description = fmt.Sprintf("%s was interrupted before it completed, please retry", record.Type)
+		record.UpdatedAt = timestamp()
+		if err := credhubServiceBroker.writeRecord(key, record); err != nil {
+			credhubServiceBroker.Logger.Error("record-operation-failed", err, lager.Data{"key": key})
+		}
+	}
+
+	return brokerapi.LastOperation{State: record.State, Description: record.Description}, nil
+}
+
+func isStale(record operationRecord) bool {
+	updatedAt, err := time.Parse(time.RFC3339, record.UpdatedAt)
+	return err != nil || time.Since(updatedAt) > staleAfter
+}
+
+func encodeOperationData(operationType, serviceID, operationID string) string {
+	return fmt.Sprintf("%s:%s:%s", operationType, serviceID, operationID)
+}
+
+func decodeOperationData(operationData string) (operationType, serviceID, operationID string, err error) {
+	first := strings.Index(operationData, ":")
+	last := strings.LastIndex(operationData, ":")
+	if first < 0 || last <= first {
+		return "", "", "", errors.New("unrecognised operation data")
+	}
+
+	return operationData[:first], operationData[first+1 : last], operationData[last+1:], nil
+}
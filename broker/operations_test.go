@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestUpdateIsRejectedWhileProvisionIsInProgress(t *testing.T) {
+	credStore := &blockingStore{Store: store.NewMemoryStore(), release: make(chan struct{})}
+	broker := newTestBroker(credStore)
+
+	spec, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"first"}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !spec.IsAsync {
+		t.Fatal("expected an asynchronous provision")
+	}
+
+	for _, asyncAllowed := range []bool{true, false} {
+		_, err = broker.Update(context.Background(), "instance", brokerapi.UpdateDetails{
+			ServiceID:     ServiceID,
+			PlanID:        PlanNameDefault,
+			RawParameters: json.RawMessage(`{"password":"second"}`),
+		}, asyncAllowed)
+		if status := failureStatus(t, err); status != http.StatusUnprocessableEntity {
+			t.Errorf("expected %d with asyncAllowed %t, got %d", http.StatusUnprocessableEntity, asyncAllowed, status)
+		}
+	}
+
+	close(credStore.release)
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	operation, err := broker.LastOperation(context.Background(), "instance", spec.OperationData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.State != brokerapi.Succeeded {
+		t.Errorf("expected the provision to succeed, got %+v", operation)
+	}
+}
+
+func TestFinalRecordIsNotOverwrittenByHeartbeat(t *testing.T) {
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = time.Millisecond
+
+	broker := newTestBroker(store.NewMemoryStore())
+	finish := make(chan struct{})
+	operationData, err := broker.startOperation(ServiceID, "instance", OperationUpdate, func() error {
+		<-finish
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(finish)
+	if err := broker.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	operation, err := broker.LastOperation(context.Background(), "instance", operationData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if operation.State != brokerapi.Succeeded {
+		t.Errorf("expected the update to succeed, got %+v", operation)
+	}
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ablease/credhub-broker/schema"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	instanceCreateSchema = "service_instance.create"
+	instanceUpdateSchema = "service_instance.update"
+	bindingCreateSchema  = "service_binding.create"
+)
+
+// planSchemas returns the parameter schemas a plan publishes in the catalog,
+// keyed by where they apply.
+func planSchemas(plan Plan) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	if plan.Schemas == nil {
+		return schemas
+	}
+
+	for name, raw := range map[string]interface{}{
+		instanceCreateSchema: plan.Schemas.Instance.Create.Schema,
+		instanceUpdateSchema: plan.Schemas.Instance.Update.Schema,
+		bindingCreateSchema:  plan.Schemas.Binding.Create.Schema,
+	} {
+		if raw != nil {
+			schemas[name] = raw
+		}
+	}
+	return schemas
+}
+
+// planSchema returns the plan's compiled schema for name, or nil when it has
+// none. Schemas of plans that were not validated are compiled on each call.
+func planSchema(plan Plan, name string) (*schema.Schema, error) {
+	if plan.compiledSchemas != nil {
+		return plan.compiledSchemas[name], nil
+	}
+
+	raw, ok := planSchemas(plan)[name]
+	if !ok {
+		return nil, nil
+	}
+	return schema.Compile(raw)
+}
+
+// validateParameters checks request parameters against the plan's schema
+// for name. Requests without parameters are checked as an empty object.
+func validateParameters(plan Plan, name string, rawParameters json.RawMessage) error {
+	compiled, err := planSchema(plan, name)
+	if err != nil {
+		return err
+	}
+	if compiled == nil {
+		return nil
+	}
+
+	var parameters interface{} = map[string]interface{}{}
+	if len(bytes.TrimSpace(rawParameters)) > 0 {
+		if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+			return brokerapi.ErrRawParamsInvalid
+		}
+	}
+
+	violations := compiled.Validate(parameters)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	messages := []string{}
+	for _, violation := range violations {
+		messages = append(messages, violation.String())
+	}
+
+	return brokerapi.NewFailureResponse(
+		fmt.Errorf("parameters do not match the plan's schema: %s", strings.Join(messages, "; ")),
+		http.StatusBadRequest, "invalid-parameters",
+	)
+}
+
+// withoutParameters removes the broker's own parameters from a request, so
+// a plan's schema only sees the parameters meant for the plan.
+func withoutParameters(rawParameters json.RawMessage, names ...string) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return rawParameters, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &fields); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+
+	for _, name := range names {
+		delete(fields, name)
+	}
+	return json.Marshal(fields)
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ablease/credhub-broker/jsonpatch"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	UpdateModeParameter = "update_mode"
+	PatchParameter      = "patch"
+
+	UpdateModeReplace    = "replace"
+	UpdateModeMergePatch = "merge-patch"
+	UpdateModeJSONPatch  = "json-patch"
+)
+
+// updateModeParameter returns the update mode and patch document from update
+// parameters. Without update_mode the parameters replace the credentials. An
+// explicit replace mode is removed from the parameters that are stored.
+func updateModeParameter(rawParameters json.RawMessage) (mode string, patch json.RawMessage, parameters json.RawMessage, err error) {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return UpdateModeReplace, nil, rawParameters, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &fields); err != nil {
+		return "", nil, nil, brokerapi.ErrRawParamsInvalid
+	}
+
+	rawMode, ok := fields[UpdateModeParameter]
+	if !ok {
+		return UpdateModeReplace, nil, rawParameters, nil
+	}
+
+	if err := json.Unmarshal(rawMode, &mode); err != nil {
+		return "", nil, nil, invalidPatch("%s must be a string", UpdateModeParameter)
+	}
+
+	switch mode {
+	case UpdateModeReplace:
+		delete(fields, UpdateModeParameter)
+		parameters, err := json.Marshal(fields)
+		return mode, nil, parameters, err
+	case UpdateModeMergePatch, UpdateModeJSONPatch:
+		patch, ok := fields[PatchParameter]
+		if !ok || len(fields) > 2 {
+			return "", nil, nil, invalidPatch("%s %s requires a %q parameter and no others", UpdateModeParameter, mode, PatchParameter)
+		}
+		return mode, patch, nil, nil
+	}
+
+	return "", nil, nil, invalidPatch("%s must be one of %s, %s or %s", UpdateModeParameter, UpdateModeReplace, UpdateModeMergePatch, UpdateModeJSONPatch)
+}
+
+// preparePatch returns the write that applies a patch to the instance's
+// current json credentials and stores the result as a new version. The patch
+// is applied once up front so a patch that does not apply is rejected
+// immediately, and again when writing so changes made in between are kept.
+func (credhubServiceBroker *CredhubServiceBroker) preparePatch(plan Plan, key, mode string, patch json.RawMessage) (func() error, error) {
+	if plan.Generate != "" {
+		return nil, brokerapi.NewFailureResponse(
+			fmt.Errorf("plan %q generates its credentials and cannot be patched", plan.Name),
+			http.StatusBadRequest, "patch-not-supported",
+		)
+	}
+
+	if _, err := credhubServiceBroker.patchCredentials(plan, key, mode, patch); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		patched, err := credhubServiceBroker.patchCredentials(plan, key, mode, patch)
+		if err != nil {
+			return err
+		}
+		return credhubServiceBroker.setCredential(key, "json", patched)
+	}, nil
+}
+
+// patchCredentials reads the instance's current json credentials and returns
+// them with the patch applied.
+func (credhubServiceBroker *CredhubServiceBroker) patchCredentials(plan Plan, key, mode string, patch json.RawMessage) (values.JSON, error) {
+	current, err := credhubServiceBroker.Store.GetLatestVersion(key)
+	if err == store.ErrNotFound {
+		return nil, brokerapi.NewFailureResponse(errors.New("the instance has no credentials to patch"), http.StatusUnprocessableEntity, "patch-failed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.Type != "json" {
+		return nil, brokerapi.NewFailureResponse(
+			fmt.Errorf("only json credentials can be patched, the instance holds a %s credential", current.Type),
+			http.StatusUnprocessableEntity, "patch-not-supported",
+		)
+	}
+
+	var patched interface{}
+	if mode == UpdateModeMergePatch {
+		var mergePatch interface{}
+		if err := json.Unmarshal(patch, &mergePatch); err != nil {
+			return nil, brokerapi.ErrRawParamsInvalid
+		}
+		patched = jsonpatch.MergePatch(current.Value, mergePatch)
+	} else {
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, invalidPatch("%s", err)
+		}
+		patched, err = jsonpatch.ApplyPatch(current.Value, operations)
+		if err != nil {
+			return nil, brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "patch-failed")
+		}
+	}
+
+	object, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, brokerapi.NewFailureResponse(errors.New("the patched credentials must be a JSON object"), http.StatusUnprocessableEntity, "patch-failed")
+	}
+
+	// the result is what a full update would have sent
+	result, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateParameters(plan, instanceUpdateSchema, result); err != nil {
+		return nil, err
+	}
+
+	return values.JSON(object), nil
+}
+
+func invalidPatch(format string, args ...interface{}) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-patch")
+}
@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+func TestPatchKeepsChangesMadeBeforeItIsWritten(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := broker.findPlan(ServiceID, PlanNameDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write, err := broker.preparePatch(plan, key, UpdateModeMergePatch, json.RawMessage(`{"username":"admin"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := credStore.SetJSON(key, values.JSON{"password": "changed"}, credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := credStore.GetLatestJSON(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "changed" || cred.Value["username"] != "admin" {
+		t.Errorf("expected both changes, got %v", cred.Value)
+	}
+}
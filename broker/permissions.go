@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const OperationsParameter = "operations"
+
+// credhubOperations are the operations CredHub can grant on a credential.
+var credhubOperations = map[string]bool{
+	"read":      true,
+	"write":     true,
+	"delete":    true,
+	"read_acl":  true,
+	"write_acl": true,
+}
+
+// defaultOperations are granted when a binding does not ask for any, and are
+// all a plan allows unless it lists allowed_operations.
+var defaultOperations = []string{"read"}
+
+func validateAllowedOperations(plan Plan) error {
+	for _, operation := range plan.AllowedOperations {
+		if !credhubOperations[operation] {
+			return fmt.Errorf("allows unknown operation %q", operation)
+		}
+	}
+
+	return nil
+}
+
+func allowedOperations(plan Plan) []string {
+	if len(plan.AllowedOperations) == 0 {
+		return defaultOperations
+	}
+	return plan.AllowedOperations
+}
+
+// operationsParameter returns the operations a binding asks for, or the
+// default operations when the operations parameter is not given.
+func operationsParameter(plan Plan, rawParameters json.RawMessage) ([]string, error) {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return defaultOperations, nil
+	}
+
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return nil, brokerapi.ErrRawParamsInvalid
+	}
+
+	rawOperations, ok := parameters[OperationsParameter]
+	if !ok {
+		return defaultOperations, nil
+	}
+
+	var operations []string
+	if err := json.Unmarshal(rawOperations, &operations); err != nil || len(operations) == 0 {
+		return nil, brokerapi.NewFailureResponse(
+			errors.New("operations must be a non-empty list of operation names"),
+			http.StatusBadRequest, "invalid-operations",
+		)
+	}
+
+	allowed := map[string]bool{}
+	for _, operation := range allowedOperations(plan) {
+		allowed[operation] = true
+	}
+
+	for _, operation := range operations {
+		if !allowed[operation] {
+			return nil, brokerapi.NewFailureResponse(
+				fmt.Errorf("operation %q is not allowed by plan %q, allowed operations are %s", operation, plan.Name, strings.Join(allowedOperations(plan), ", ")),
+				http.StatusBadRequest, "operation-not-allowed",
+			)
+		}
+	}
+
+	return mergeOperations(nil, operations), nil
+}
+
+// regrantOperations restores the operations other bindings of the same actor
+// still hold on a credential after one binding's permission was revoked, as
+// CredHub only revokes an actor's permission as a whole.
+func (credhubServiceBroker *CredhubServiceBroker) regrantOperations(serviceID, instanceID, bindingID, key, actor string) error {
+	instanceKey := constructKey(serviceID, instanceID, CredentialsID)
+	instancePath := constructKey(serviceID, instanceID, "")
+
+	results, err := credhubServiceBroker.Store.FindByPath(instancePath)
+	if err != nil {
+		return err
+	}
+
+	var operations []string
+	for _, credential := range results.Credentials {
+		leaf := strings.TrimPrefix(credential.Name, instancePath)
+		if strings.Contains(leaf, "/") || reservedBindingID(leaf) || leaf == bindingID {
+			continue
+		}
+
+		binding, err := readBinding(credhubServiceBroker.Store, credential.Name)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if binding.Actor == actor && binding.credentialName(instanceKey) == key {
+			operations = mergeOperations(operations, binding.operations())
+		}
+	}
+
+	if len(operations) == 0 {
+		return nil
+	}
+
+	return credhubServiceBroker.Store.AddPermissions(key, []permissions.Permission{
+		{
+			Actor:      actor,
+			Operations: operations,
+		},
+	})
+}
+
+func mergeOperations(existing []string, additional []string) []string {
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, operation := range append(append([]string{}, existing...), additional...) {
+		if !seen[operation] {
+			seen[operation] = true
+			merged = append(merged, operation)
+		}
+	}
+
+	sort.Strings(merged)
+	return merged
+}
@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func bindWithParameters(rawParameters string) brokerapi.BindDetails {
+	details := bindDetails(``)
+	details.RawParameters = json.RawMessage(rawParameters)
+	return details
+}
+
+// actorOperations returns the sorted operations granted to actor on key.
+func actorOperations(t *testing.T, credStore store.Store, key, actor string) []string {
+	t.Helper()
+	perms, err := credStore.GetPermissions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, perm := range perms {
+		if perm.Actor == actor {
+			// the store keeps the order operations were granted in
+			return mergeOperations(nil, perm.Operations)
+		}
+	}
+	return nil
+}
+
+func TestBindGrantsTheRequestedOperations(t *testing.T) {
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	for _, test := range []struct {
+		name              string
+		allowedOperations []string
+		parameters        string
+		operations        []string
+		status            int
+	}{
+		{"no parameters", nil, ``, []string{"read"}, 0},
+		{"no operations parameter", []string{"read", "write"}, `{}`, []string{"read"}, 0},
+		{"allowed operations", []string{"read", "write"}, `{"operations":["write","read","write"]}`, []string{"read", "write"}, 0},
+		{"operation outside the defaults", nil, `{"operations":["write"]}`, nil, http.StatusBadRequest},
+		{"operation outside allowed_operations", []string{"read", "write"}, `{"operations":["read","delete"]}`, nil, http.StatusBadRequest},
+		{"empty operations", []string{"read"}, `{"operations":[]}`, nil, http.StatusBadRequest},
+		{"operations that are not a list", []string{"read"}, `{"operations":"read"}`, nil, http.StatusBadRequest},
+	} {
+		credStore := store.NewMemoryStore()
+		broker := newTestBroker(credStore)
+		broker.Catalog.Services[0].Plans[0].AllowedOperations = test.allowedOperations
+		if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := broker.Bind(context.Background(), "instance", "binding", bindWithParameters(test.parameters))
+		if test.status != 0 {
+			if status := failureStatus(t, err); status != test.status {
+				t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+			}
+			if operations := actorOperations(t, credStore, key, "mtls-app:app-guid"); operations != nil {
+				t.Errorf("%s: expected no access to be granted, got %v", test.name, operations)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if operations := actorOperations(t, credStore, key, "mtls-app:app-guid"); !reflect.DeepEqual(operations, test.operations) {
+			t.Errorf("%s: expected %v to be granted, got %v", test.name, test.operations, operations)
+		}
+	}
+}
+
+func TestUnbindKeepsTheOperationsOfTheActorsOtherBindings(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	broker.Catalog.Services[0].Plans[0].AllowedOperations = []string{"read", "write", "delete"}
+	key := constructKey(ServiceID, "instance", CredentialsID)
+	unbindDetails := brokerapi.UnbindDetails{ServiceID: ServiceID, PlanID: PlanNameDefault}
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	for bindingID, parameters := range map[string]string{
+		"reader":  `{"operations":["read"]}`,
+		"writer":  `{"operations":["read","write"]}`,
+		"deleter": `{"operations":["delete"]}`,
+	} {
+		if _, err := broker.Bind(context.Background(), "instance", bindingID, bindWithParameters(parameters)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if operations := actorOperations(t, credStore, key, "mtls-app:app-guid"); !reflect.DeepEqual(operations, []string{"delete", "read", "write"}) {
+		t.Fatalf("expected the operations of every binding, got %v", operations)
+	}
+
+	for _, test := range []struct {
+		bindingID  string
+		operations []string
+	}{
+		{"writer", []string{"delete", "read"}},
+		{"deleter", []string{"read"}},
+		{"reader", nil},
+	} {
+		if err := broker.Unbind(context.Background(), "instance", test.bindingID, unbindDetails); err != nil {
+			t.Fatal(err)
+		}
+		if operations := actorOperations(t, credStore, key, "mtls-app:app-guid"); !reflect.DeepEqual(operations, test.operations) {
+			t.Errorf("after unbinding %s: expected %v, got %v", test.bindingID, test.operations, operations)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+)
+
+const (
+	OrphanedBinding    = "binding"
+	OrphanedPermission = "permission"
+)
+
+// managedActorPrefixes are the actor types the broker grants access to. Any
+// other actor on an instance credential was not granted by a binding and is
+// left alone.
+var managedActorPrefixes = []string{"mtls-app:", "uaa-client:"}
+
+// DefaultReconcileGracePeriod is how long records are left alone after they
+// are written, long enough for any bind, unbind or provision to finish.
+const DefaultReconcileGracePeriod = 5 * time.Minute
+
+type Orphan struct {
+	Kind           string `json:"kind"`
+	CredentialName string `json:"credential_name"`
+	Actor          string `json:"actor,omitempty"`
+	Deleted        bool   `json:"deleted"`
+
+	// instancePath and bindingKey are the records the orphan was found
+	// from, they are read again before it is deleted
+	instancePath string
+	bindingKey   string
+}
+
+type ReconcileReport struct {
+	Orphans []Orphan `json:"orphans"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Reconciler finds binding records and binding credentials whose instance or
+// binding no longer exists, and permissions on instance credentials that no
+// binding record accounts for. Binding credentials outside the instance's
+// path are found through the binding records that name them.
+// Orphans are only reported unless DeleteOrphans is set.
+type Reconciler struct {
+	Store         store.Store
+	Logger        lager.Logger
+	Interval      time.Duration
+	DeleteOrphans bool
+
+	// GracePeriod leaves out binding records and binding credentials
+	// written more recently, as the request that wrote them may still be
+	// granting or revoking access.
+	GracePeriod time.Duration
+
+	// IgnoredActors are never reported as orphans, such as the broker's own
+	// UAA client which CredHub grants access to everything it writes.
+	IgnoredActors []string
+
+	mutex sync.Mutex
+}
+
+// Run reconciles every Interval until stop is closed.
+func (reconciler *Reconciler) Run(stop <-chan struct{}) {
+	if reconciler.Interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(reconciler.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := reconciler.Reconcile(reconciler.DeleteOrphans); err != nil {
+				reconciler.Logger.Error("reconcile-failed", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (reconciler *Reconciler) Reconcile(deleteOrphans bool) (ReconcileReport, error) {
+	reconciler.mutex.Lock()
+	defer reconciler.mutex.Unlock()
+
+	logger := reconciler.Logger.Session("reconcile", lager.Data{"delete-orphans": deleteOrphans})
+	logger.Info("starting")
+
+	report := ReconcileReport{Orphans: []Orphan{}}
+
+	instancePaths, err := reconciler.instancePaths()
+	if err != nil {
+		return report, err
+	}
+
+	for _, instancePath := range instancePaths {
+		orphans, err := reconciler.findOrphans(instancePath)
+		if err != nil {
+			logger.Error("find-orphans-failed", err, lager.Data{"path": instancePath})
+			report.Errors = append(report.Errors, err.Error())
+			continue
+		}
+
+		for _, orphan := range orphans {
+			data := lager.Data{"kind": orphan.Kind, "name": orphan.CredentialName, "actor": orphan.Actor}
+			if deleteOrphans {
+				deleted, err := reconciler.deleteOrphan(orphan)
+				switch {
+				case err != nil && err != store.ErrNotFound:
+					logger.Error("delete-orphan-failed", err, data)
+					report.Errors = append(report.Errors, err.Error())
+				case err == nil && !deleted:
+					logger.Info("orphan-in-use", data)
+					continue
+				default:
+					orphan.Deleted = true
+				}
+			}
+			logger.Info("found-orphan", data)
+			report.Orphans = append(report.Orphans, orphan)
+		}
+	}
+
+	logger.Info("finished", lager.Data{"orphans": len(report.Orphans), "errors": len(report.Errors)})
+	return report, nil
+}
+
+// instancePaths returns the /c/<broker>/<service>/<instance>/ paths that hold
+// credentials.
+func (reconciler *Reconciler) instancePaths() ([]string, error) {
+	paths, err := reconciler.Store.FindAllPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	root := fmt.Sprintf("/c/%s/", BrokerID)
+	instancePaths := []string{}
+	for _, path := range paths.Paths {
+		if !strings.HasPrefix(path.Path, root) {
+			continue
+		}
+
+		segments := strings.Split(strings.Trim(strings.TrimPrefix(path.Path, root), "/"), "/")
+		if len(segments) == 2 {
+			instancePaths = append(instancePaths, path.Path)
+		}
+	}
+
+	return instancePaths, nil
+}
+
+// Count returns how many service instances and bindings are stored.
+func (reconciler *Reconciler) Count() (int, int, error) {
+	instancePaths, err := reconciler.instancePaths()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	instances, bindings := 0, 0
+	for _, instancePath := range instancePaths {
+		results, err := reconciler.Store.FindByPath(instancePath)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, credential := range results.Credentials {
+			leaf := strings.TrimPrefix(credential.Name, instancePath)
+			switch {
+			case leaf == CredentialsID:
+				instances++
+			case leaf == OperationID, leaf == MetadataID, strings.Contains(leaf, "/"):
+			default:
+				bindings++
+			}
+		}
+	}
+
+	return instances, bindings, nil
+}
+
+func (reconciler *Reconciler) findOrphans(instancePath string) ([]Orphan, error) {
+	results, err := reconciler.Store.FindByPath(instancePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// an instance whose credentials are still being written by an
+	// asynchronous provision already has its metadata
+	credentialsKey := instancePath + CredentialsID
+	hasCredentials, instanceExists := false, false
+	bindingKeys := []string{}
+	bindingCredentials := []credentials.Base{}
+	for _, credential := range results.Credentials {
+		leaf := strings.TrimPrefix(credential.Name, instancePath)
+		switch {
+		case leaf == CredentialsID:
+			hasCredentials, instanceExists = true, true
+		case leaf == MetadataID:
+			instanceExists = true
+		case leaf == OperationID:
+		case !strings.Contains(leaf, "/"):
+			bindingKeys = append(bindingKeys, credential.Name)
+		default:
+			bindingCredentials = append(bindingCredentials, credential)
+		}
+	}
+
+	orphans := []Orphan{}
+	bindingExists := map[string]bool{}
+	for _, bindingKey := range bindingKeys {
+		bindingExists[bindingKey] = true
+	}
+	for _, credential := range bindingCredentials {
+		bindingKey := instancePath + strings.SplitN(strings.TrimPrefix(credential.Name, instancePath), "/", 2)[0]
+		if reconciler.recent(credential.VersionCreatedAt) {
+			continue
+		}
+		if !instanceExists || !bindingExists[bindingKey] {
+			orphans = append(orphans, Orphan{Kind: OrphanedBinding, CredentialName: credential.Name, instancePath: instancePath, bindingKey: bindingKey})
+		}
+	}
+
+	boundActors := map[string]bool{}
+	for _, bindingKey := range bindingKeys {
+		binding, err := readBinding(reconciler.Store, bindingKey)
+		if err != nil {
+			reconciler.Logger.Error("read-binding-failed", err, lager.Data{"name": bindingKey})
+			continue
+		}
+
+		actor := binding.Actor
+		if !instanceExists {
+			if reconciler.recent(binding.CreatedAt) {
+				continue
+			}
+			// a credential kept outside the instance's path, such as one a
+			// Kubernetes rule places, is only known from its binding record,
+			// so it is reported before the record
+			if binding.CredentialName != "" && !strings.HasPrefix(binding.CredentialName, instancePath) {
+				orphans = append(orphans, Orphan{Kind: OrphanedBinding, CredentialName: binding.CredentialName, Actor: actor, instancePath: instancePath, bindingKey: bindingKey})
+			}
+			orphans = append(orphans, Orphan{Kind: OrphanedBinding, CredentialName: bindingKey, Actor: actor, instancePath: instancePath, bindingKey: bindingKey})
+			continue
+		}
+		boundActors[actor] = true
+	}
+
+	if !hasCredentials {
+		return orphans, nil
+	}
+
+	perms, err := reconciler.Store.GetPermissions(credentialsKey)
+	if err == store.ErrNotFound {
+		// deleted since it was listed, along with its permissions
+		return orphans, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, perm := range perms {
+		if reconciler.isManagedActor(perm.Actor) && !boundActors[perm.Actor] {
+			orphans = append(orphans, Orphan{Kind: OrphanedPermission, CredentialName: credentialsKey, Actor: perm.Actor, instancePath: instancePath})
+		}
+	}
+
+	return orphans, nil
+}
+
+// deleteOrphan deletes an orphan unless reading its records again shows it
+// is in use, as a bind may have stored its record and granted its
+// permission since they were listed. It reports whether it was deleted.
+func (reconciler *Reconciler) deleteOrphan(orphan Orphan) (bool, error) {
+	orphaned, err := reconciler.stillOrphaned(orphan)
+	if err != nil || !orphaned {
+		return false, err
+	}
+
+	switch orphan.Kind {
+	case OrphanedBinding:
+		return true, reconciler.Store.Delete(orphan.CredentialName)
+	case OrphanedPermission:
+		return true, reconciler.Store.DeletePermissions(orphan.CredentialName, orphan.Actor)
+	}
+
+	return false, fmt.Errorf("unknown orphan kind %q", orphan.Kind)
+}
+
+func (reconciler *Reconciler) stillOrphaned(orphan Orphan) (bool, error) {
+	instanceExists, err := reconciler.instanceExists(orphan.instancePath)
+	if err != nil {
+		return false, err
+	}
+
+	if orphan.Kind == OrphanedPermission {
+		if !instanceExists {
+			return false, nil
+		}
+		boundActors, err := reconciler.boundActors(orphan.instancePath)
+		return !boundActors[orphan.Actor], err
+	}
+
+	// binding records are only orphaned with their instance, and the
+	// binding's credentials also when the record is gone
+	if !instanceExists {
+		return true, nil
+	}
+	if orphan.bindingKey == orphan.CredentialName {
+		return false, nil
+	}
+
+	_, err = readBinding(reconciler.Store, orphan.bindingKey)
+	if err == store.ErrNotFound {
+		return true, nil
+	}
+	return false, err
+}
+
+func (reconciler *Reconciler) instanceExists(instancePath string) (bool, error) {
+	for _, id := range []string{CredentialsID, MetadataID} {
+		_, err := reconciler.Store.GetLatestVersion(instancePath + id)
+		if err == nil {
+			return true, nil
+		}
+		if err != store.ErrNotFound {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// boundActors returns the actors of the binding records of an instance.
+func (reconciler *Reconciler) boundActors(instancePath string) (map[string]bool, error) {
+	results, err := reconciler.Store.FindByPath(instancePath)
+	if err != nil {
+		return nil, err
+	}
+
+	actors := map[string]bool{}
+	for _, credential := range results.Credentials {
+		leaf := strings.TrimPrefix(credential.Name, instancePath)
+		if strings.Contains(leaf, "/") || reservedBindingID(leaf) {
+			continue
+		}
+
+		binding, err := readBinding(reconciler.Store, credential.Name)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		actors[binding.Actor] = true
+	}
+
+	return actors, nil
+}
+
+// recent reports whether a record written at createdAt is within the grace
+// period. Records from before the broker kept the time are not.
+func (reconciler *Reconciler) recent(createdAt string) bool {
+	created, err := time.Parse(time.RFC3339, createdAt)
+	return err == nil && time.Since(created) < reconciler.GracePeriod
+}
+
+func (reconciler *Reconciler) isManagedActor(actor string) bool {
+	for _, ignored := range reconciler.IgnoredActors {
+		if actor == ignored {
+			return false
+		}
+	}
+
+	for _, prefix := range managedActorPrefixes {
+		if strings.HasPrefix(actor, prefix) {
+			return true
+		}
+	}
+	return false
+}
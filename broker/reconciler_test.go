@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+// bindingStore stores a binding record the first time the permissions of a
+// credential are read, as a bind running during a scan would.
+type bindingStore struct {
+	store.Store
+	bind func()
+}
+
+func (bindingStore *bindingStore) GetPermissions(name string) ([]permissions.Permission, error) {
+	if bindingStore.bind != nil {
+		bindingStore.bind()
+		bindingStore.bind = nil
+	}
+	return bindingStore.Store.GetPermissions(name)
+}
+
+func newTestReconciler(credStore store.Store) *Reconciler {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	return &Reconciler{Store: credStore, Logger: logger, GracePeriod: DefaultReconcileGracePeriod}
+}
+
+func TestReconcileKeepsPermissionsOfBindingsMadeDuringTheScan(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	key := constructKey(ServiceID, "instance", CredentialsID)
+	racing := &bindingStore{Store: credStore, bind: func() {
+		if _, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(``)); err != nil {
+			t.Fatal(err)
+		}
+	}}
+
+	report, err := newTestReconciler(racing).Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Errorf("expected no orphans, got %+v", report.Orphans)
+	}
+
+	perms, err := credStore.GetPermissions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perms) != 1 || perms[0].Actor != "mtls-app:app-guid" {
+		t.Errorf("expected the binding's permission to be kept, got %+v", perms)
+	}
+}
+
+func TestReconcileSkipsRecentBindingRecords(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+
+	recent := bindingRecord{Actor: "mtls-app:recent", CreatedAt: timestamp()}
+	old := bindingRecord{Actor: "mtls-app:old", CreatedAt: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)}
+	for id, record := range map[string]bindingRecord{"recent": recent, "old": old} {
+		if err := broker.writeRecord(constructKey(ServiceID, "deleted-instance", id), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := newTestReconciler(credStore).Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Actor != "mtls-app:old" || !report.Orphans[0].Deleted {
+		t.Errorf("expected only the old binding to be deleted, got %+v", report.Orphans)
+	}
+
+	if _, err := credStore.GetLatestVersion(constructKey(ServiceID, "deleted-instance", "recent")); err != nil {
+		t.Errorf("expected the recent binding record to be kept, got %s", err)
+	}
+}
+
+func TestReconcileDeletesPermissionsWithoutABinding(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	key := constructKey(ServiceID, "instance", CredentialsID)
+	if err := credStore.AddPermissions(key, []permissions.Permission{{Actor: "mtls-app:gone", Operations: []string{"read"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := newTestReconciler(credStore).Reconcile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Kind != OrphanedPermission || !report.Orphans[0].Deleted {
+		t.Errorf("expected the permission to be deleted, got %+v", report.Orphans)
+	}
+
+	perms, err := credStore.GetPermissions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(perms) != 0 {
+		t.Errorf("expected no permissions, got %+v", perms)
+	}
+}
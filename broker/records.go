@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+// writeRecord stores broker bookkeeping as a json credential next to the
+// instance it describes, so it survives restarts and is visible to every
+// broker instance.
+func (credhubServiceBroker *CredhubServiceBroker) writeRecord(key string, record interface{}) error {
+	value, err := recordValue(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = credhubServiceBroker.Store.SetJSON(key, value, credhub.Overwrite)
+	return err
+}
+
+// createRecord stores a record unless one already exists, and reports
+// whether the stored record is the one given, so a concurrent request that
+// got there first is not mistaken for this one.
+func (credhubServiceBroker *CredhubServiceBroker) createRecord(key string, record interface{}) (bool, error) {
+	value, err := recordValue(record)
+	if err != nil {
+		return false, err
+	}
+
+	stored, err := credhubServiceBroker.Store.SetJSON(key, value, credhub.NoOverwrite)
+	if err != nil {
+		return false, err
+	}
+
+	return reflect.DeepEqual(map[string]interface{}(stored.Value), map[string]interface{}(value)), nil
+}
+
+func recordValue(record interface{}) (values.JSON, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+
+	var value values.JSON
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+func (credhubServiceBroker *CredhubServiceBroker) readRecord(key string, record interface{}) error {
+	cred, err := credhubServiceBroker.Store.GetLatestJSON(key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(cred.Value)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, record)
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
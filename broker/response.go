@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+type contextKey int
+
+const responseKey contextKey = 0
+
+// response carries what the broker learns while handling a request that
+// the broker API cannot express through its return values.
+type response struct {
+	alreadyExists bool
+	retryAfter    time.Duration
+}
+
+// ResponseStatusHandler lets the broker answer a repeated provision or bind
+// with 200 OK, as the broker API otherwise always answers 201 Created, and
+// say when to retry a request refused while CredHub is unavailable.
+func ResponseStatusHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		resp := &response{}
+		ctx := context.WithValue(req.Context(), responseKey, resp)
+		handler.ServeHTTP(&statusWriter{ResponseWriter: w, response: resp}, req.WithContext(ctx))
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	response *response
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if status == http.StatusCreated && w.response.alreadyExists {
+		status = http.StatusOK
+	}
+	if status == http.StatusServiceUnavailable && w.response.retryAfter > 0 {
+		seconds := int((w.response.retryAfter + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// markAlreadyExists records that the request matched an existing instance
+// or binding.
+func markAlreadyExists(ctx context.Context) {
+	if resp, ok := ctx.Value(responseKey).(*response); ok {
+		resp.alreadyExists = true
+	}
+}
+
+// unavailable turns an error from CredHub being unreachable into a 503, with
+// a Retry-After while the circuit breaker is open. Other errors are returned
+// as they are.
+func unavailable(ctx context.Context, err error) error {
+	if !store.IsTransient(err) {
+		return err
+	}
+
+	var unavailableErr *store.UnavailableError
+	if errors.As(err, &unavailableErr) {
+		if resp, ok := ctx.Value(responseKey).(*response); ok {
+			resp.retryAfter = unavailableErr.RetryAfter
+		}
+	}
+
+	return brokerapi.NewFailureResponse(err, http.StatusServiceUnavailable, "credhub-unavailable")
+}
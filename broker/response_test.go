@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+// unreachableStore cannot reach CredHub to write instance credentials.
+type unreachableStore struct {
+	store.Store
+}
+
+func (unreachableStore) unreachable(name string) error {
+	if strings.HasSuffix(name, "/"+CredentialsID) {
+		return &url.Error{Op: "Put", URL: name, Err: errors.New("connection refused")}
+	}
+	return nil
+}
+
+func (unreachableStore unreachableStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	if err := unreachableStore.unreachable(name); err != nil {
+		return credentials.JSON{}, err
+	}
+	return unreachableStore.Store.SetJSON(name, value, mode)
+}
+
+func (unreachableStore unreachableStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	if err := unreachableStore.unreachable(name); err != nil {
+		return credentials.Password{}, err
+	}
+	return unreachableStore.Store.GeneratePassword(name, gen, mode)
+}
+
+type discardObserver struct{}
+
+func (discardObserver) ObserveRetry(method string, err error) {}
+func (discardObserver) ObserveRejected(method string)         {}
+func (discardObserver) ObserveCircuit(open bool)              {}
+
+func TestProvisionIsUnavailableWhenCredHubCannotBeReached(t *testing.T) {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	config := store.ResilienceConfig{Attempts: 2}
+
+	for planID, parameters := range map[string]string{
+		PlanNameDefault: `{"password":"secret"}`,
+		"password":      ``,
+	} {
+		credStore := store.NewResilientStore(unreachableStore{store.NewMemoryStore()}, config, discardObserver{}, logger)
+		broker := newTestBroker(credStore)
+
+		_, err := broker.Provision(context.Background(), "instance", provisionDetails(planID, parameters), false)
+		if status := failureStatus(t, err); status != http.StatusServiceUnavailable {
+			t.Errorf("expected %d for plan %s, got %d", http.StatusServiceUnavailable, planID, status)
+		}
+	}
+}
+
+func TestProvisionSaysWhenToRetryWhileTheCircuitIsOpen(t *testing.T) {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	config := store.ResilienceConfig{Attempts: 1, FailureThreshold: 1, Cooldown: 30 * time.Second}
+	credStore := store.NewResilientStore(unreachableStore{store.NewMemoryStore()}, config, discardObserver{}, logger)
+	broker := newTestBroker(credStore)
+
+	handler := ResponseStatusHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, err := broker.Provision(req.Context(), req.URL.Query().Get("instance"), provisionDetails(PlanNameDefault, `{"password":"secret"}`), false)
+		w.WriteHeader(failureStatus(t, err))
+	}))
+
+	first := httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest("PUT", "/?instance=first", nil))
+	if first.Code != http.StatusServiceUnavailable || first.Header().Get("Retry-After") != "" {
+		t.Errorf("expected a 503 without Retry-After while CredHub is called, got %d %q", first.Code, first.Header().Get("Retry-After"))
+	}
+
+	second := httptest.NewRecorder()
+	handler.ServeHTTP(second, httptest.NewRequest("PUT", "/?instance=second", nil))
+	if second.Code != http.StatusServiceUnavailable || second.Header().Get("Retry-After") != "30" {
+		t.Errorf("expected a 503 with Retry-After 30, got %d %q", second.Code, second.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const RestoreParameter = "restore"
+
+// restoreParameters names an earlier version of the instance's credentials,
+// either by its CredHub version id or by how many versions it is behind the
+// current one.
+type restoreParameters struct {
+	VersionID string `json:"version_id,omitempty"`
+	Index     *int   `json:"index,omitempty"`
+}
+
+// CredentialVersion describes a version of a credential without its value.
+type CredentialVersion struct {
+	ID               string `json:"id"`
+	Index            int    `json:"index"`
+	Type             string `json:"type"`
+	VersionCreatedAt string `json:"version_created_at"`
+}
+
+// restoreParameter returns the restore update parameter and whether it was
+// given. It cannot be combined with other parameters.
+func restoreParameter(rawParameters json.RawMessage) (restoreParameters, bool, error) {
+	var restore restoreParameters
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return restore, false, nil
+	}
+
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return restore, false, brokerapi.ErrRawParamsInvalid
+	}
+
+	rawRestore, ok := parameters[RestoreParameter]
+	if !ok {
+		return restore, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(rawRestore))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&restore)
+
+	switch {
+	case err != nil:
+	case len(parameters) > 1:
+		err = errors.New("restore cannot be combined with other parameters")
+	case (restore.VersionID == "") == (restore.Index == nil):
+		err = errors.New("restore requires exactly one of version_id and index")
+	case restore.Index != nil && *restore.Index < 1:
+		err = errors.New("restore index must be 1 or more, 1 being the version before the current one")
+	}
+
+	if err != nil {
+		return restore, false, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "invalid-restore-parameters")
+	}
+
+	return restore, true, nil
+}
+
+// prepareRestore finds the requested version and returns the write that
+// stores it as the new current version. Only credentials that were set, not
+// generated, are restored this way.
+func (credhubServiceBroker *CredhubServiceBroker) prepareRestore(key string, restore restoreParameters) (func() error, error) {
+	var version credentials.Credential
+
+	if restore.VersionID != "" {
+		cred, err := credhubServiceBroker.Store.GetById(restore.VersionID)
+		if err != nil && err != store.ErrNotFound {
+			return nil, err
+		}
+		// ids are global, so only accept versions of this instance's credential
+		if err == store.ErrNotFound || cred.Name != key {
+			return nil, versionNotFound("version %q of the instance's credentials does not exist", restore.VersionID)
+		}
+		version = cred
+	} else {
+		versions, err := credhubServiceBroker.Store.GetNVersions(key, *restore.Index+1)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) <= *restore.Index {
+			return nil, versionNotFound("the instance's credentials have only %d versions", len(versions))
+		}
+		version = versions[*restore.Index]
+	}
+
+	value, err := credentialValue(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return credhubServiceBroker.setCredential(key, version.Type, value)
+	}, nil
+}
+
+// CredentialVersions lists the versions of an instance's credentials, newest
+// first, leaving out their values.
+func (credhubServiceBroker *CredhubServiceBroker) CredentialVersions(serviceID, instanceID string) ([]CredentialVersion, error) {
+	creds, err := credhubServiceBroker.Store.GetAllVersions(constructKey(serviceID, instanceID, CredentialsID))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []CredentialVersion{}
+	for i, cred := range creds {
+		versions = append(versions, CredentialVersion{
+			ID:               cred.Id,
+			Index:            i,
+			Type:             cred.Type,
+			VersionCreatedAt: cred.VersionCreatedAt,
+		})
+	}
+
+	return versions, nil
+}
+
+// credentialValue converts the value of a version read back from CredHub
+// into the value type its Set call expects.
+func credentialValue(version credentials.Credential) (interface{}, error) {
+	var value interface{}
+	switch version.Type {
+	case "json":
+		value = &values.JSON{}
+	case "password":
+		value = new(values.Password)
+	case "user":
+		value = &values.User{}
+	case "certificate":
+		value = &values.Certificate{}
+	case "rsa":
+		value = &values.RSA{}
+	case "ssh":
+		value = &values.SSH{}
+	default:
+		return nil, fmt.Errorf("unsupported credential type %q", version.Type)
+	}
+
+	data, err := json.Marshal(version.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return nil, err
+	}
+
+	switch value := value.(type) {
+	case *values.JSON:
+		return *value, nil
+	case *values.Password:
+		return *value, nil
+	case *values.User:
+		return *value, nil
+	case *values.Certificate:
+		// CredHub signs with the named CA and rejects a value with both
+		if value.CaName != "" {
+			value.Ca = ""
+		}
+		return *value, nil
+	case *values.RSA:
+		return *value, nil
+	default:
+		return *value.(*values.SSH), nil
+	}
+}
+
+func versionNotFound(format string, args ...interface{}) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf(format, args...), http.StatusUnprocessableEntity, "version-not-found")
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func updateDetails(planID, parameters string) brokerapi.UpdateDetails {
+	return brokerapi.UpdateDetails{
+		ServiceID:     ServiceID,
+		PlanID:        planID,
+		RawParameters: json.RawMessage(parameters),
+	}
+}
+
+func TestRotateAfterRestoreOfGeneratedCredential(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails("password", `{"length":20}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Update(context.Background(), "instance", updateDetails("password", `{"rotate":true}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := broker.Update(context.Background(), "instance", updateDetails("password", `{"restore":{"index":1}}`), false)
+	if status := failureStatus(t, err); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected restoring a generated credential to be refused with %d, got %d", http.StatusUnprocessableEntity, status)
+	}
+
+	before, err := credStore.GetLatestVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Update(context.Background(), "instance", updateDetails("password", `{"rotate":true}`), false); err != nil {
+		t.Fatalf("expected rotate to succeed after a restore attempt, got %s", err)
+	}
+	after, err := credStore.GetLatestVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Value == before.Value {
+		t.Error("expected rotate to change the password")
+	}
+}
+
+func TestRestoreOfSetCredential(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"first"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, `{"password":"second"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, `{"restore":{"index":1}}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := credStore.GetLatestJSON(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "first" {
+		t.Errorf("expected the first version to be restored, got %v", cred.Value)
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const RotateParameter = "rotate"
+
+// rotateParameter returns the rotate update parameter and whether it was
+// given. It cannot be combined with other parameters.
+func rotateParameter(rawParameters json.RawMessage) (rotate bool, ok bool, err error) {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return false, false, nil
+	}
+
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return false, false, brokerapi.ErrRawParamsInvalid
+	}
+
+	rawRotate, ok := parameters[RotateParameter]
+	if !ok {
+		return false, false, nil
+	}
+
+	if err := json.Unmarshal(rawRotate, &rotate); err != nil || len(parameters) > 1 {
+		return false, false, brokerapi.NewFailureResponse(
+			errors.New(`rotate must be true or false and cannot be combined with other parameters`),
+			http.StatusBadRequest, "invalid-rotate-parameters",
+		)
+	}
+
+	return rotate, true, nil
+}
+
+// rotateInstance regenerates every credential in the instance, keeping
+// their names so bound apps pick up the new values on restage. Binding
+// credentials copied from the instance are copied again. When the plan
+// stores user-provided credentials only the bindings' are regenerated.
+func (credhubServiceBroker *CredhubServiceBroker) rotateInstance(plan Plan, serviceID, instanceID string) error {
+	logger := credhubServiceBroker.Logger.Session("rotate", lager.Data{"instance-id": instanceID})
+
+	names, err := credhubServiceBroker.instanceCredentials(serviceID, instanceID)
+	if err != nil {
+		return err
+	}
+
+	// the instance's credential goes first so binding copies pick up its new value
+	instanceKey := constructKey(serviceID, instanceID, CredentialsID)
+	sort.SliceStable(names, func(i, j int) bool {
+		return names[i] == instanceKey && names[j] != instanceKey
+	})
+
+	for _, name := range names {
+		if name == instanceKey && plan.Generate == "" {
+			continue
+		}
+
+		logger.Info("regenerating", lager.Data{"key": name})
+		_, err := credhubServiceBroker.Store.Regenerate(name)
+		if err == store.ErrNotGenerated && name != instanceKey {
+			err = credhubServiceBroker.copyCredential(instanceKey, name)
+		}
+		if err != nil {
+			if err == store.ErrNotGenerated {
+				return brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "rotation-not-supported")
+			}
+			return err
+		}
+
+		rotatedAt := timestamp()
+		err = credhubServiceBroker.updateMetadata(serviceID, instanceID, func(metadata *instanceMetadata) {
+			if metadata.LastRotated == nil {
+				metadata.LastRotated = map[string]string{}
+			}
+			metadata.LastRotated[name] = rotatedAt
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// instanceCredentials returns the names of the credentials held by an
+// instance, leaving out the broker's own records.
+func (credhubServiceBroker *CredhubServiceBroker) instanceCredentials(serviceID, instanceID string) ([]string, error) {
+	results, err := credhubServiceBroker.Store.FindByPath(constructKey(serviceID, instanceID, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, credential := range results.Credentials {
+		if strings.HasSuffix(credential.Name, "/"+CredentialsID) {
+			names = append(names, credential.Name)
+		}
+	}
+
+	return names, nil
+}
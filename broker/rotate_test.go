@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+)
+
+func TestRotateIsRefusedForUserProvidedCredentials(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, `{"rotate":true}`), false)
+	if status := failureStatus(t, err); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected %d, got %d", http.StatusUnprocessableEntity, status)
+	}
+
+	cred, err := credStore.GetLatestJSON(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "secret" || len(cred.Value) != 1 {
+		t.Errorf("expected the credentials to be kept, got %v", cred.Value)
+	}
+}
+
+func TestRotateRegeneratesBindingCredentialsOfUserProvidedInstances(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	plan := &broker.Catalog.Services[0].Plans[0]
+	plan.BindingCredentials = BindingCredentialsGenerate
+	plan.BindingTemplate = &BindingTemplate{Generate: "password", Parameters: json.RawMessage(`{"length":30}`)}
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(``)); err != nil {
+		t.Fatal(err)
+	}
+
+	bindingKey := bindingCredentialsKey(ServiceID, "instance", "binding")
+	before, err := credStore.GetLatestVersion(bindingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, `{"rotate":true}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := credStore.GetLatestVersion(bindingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Id == before.Id {
+		t.Error("expected the binding's password to be regenerated")
+	}
+
+	cred, err := credStore.GetLatestJSON(constructKey(ServiceID, "instance", CredentialsID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "secret" {
+		t.Errorf("expected the instance's credentials to be kept, got %v", cred.Value)
+	}
+}
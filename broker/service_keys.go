@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const ClientIDParameter = "client_id"
+
+// bindingActor returns the CredHub actor a binding grants access to. Apps are
+// identified by their instance identity certificates, service keys by a UAA
+// client. It returns an empty actor for service keys of plans that return
+// their credentials inline.
+func bindingActor(plan Plan, details brokerapi.BindDetails) (string, error) {
+	appGUID := details.AppGUID
+	clientID := ""
+	if details.BindResource != nil {
+		if details.BindResource.AppGuid != "" {
+			appGUID = details.BindResource.AppGuid
+		}
+		clientID = details.BindResource.CredentialClientID
+	}
+
+	if appGUID != "" {
+		return "mtls-app:" + appGUID, nil
+	}
+	if plan.InlineServiceKeys {
+		return "", nil
+	}
+
+	if clientID == "" {
+		parameter, err := clientIDParameter(details.RawParameters)
+		if err != nil {
+			return "", err
+		}
+		clientID = parameter
+	}
+	if clientID == "" {
+		return "", brokerapi.NewFailureResponse(
+			errors.New("No app-guid or client id was provided in the binding request, you must have one"),
+			http.StatusUnprocessableEntity, "missing-binding-actor",
+		)
+	}
+
+	return "uaa-client:" + clientID, nil
+}
+
+func clientIDParameter(rawParameters json.RawMessage) (string, error) {
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return "", nil
+	}
+
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return "", brokerapi.ErrRawParamsInvalid
+	}
+
+	rawClientID, ok := parameters[ClientIDParameter]
+	if !ok {
+		return "", nil
+	}
+
+	var clientID string
+	if err := json.Unmarshal(rawClientID, &clientID); err != nil || clientID == "" {
+		return "", brokerapi.NewFailureResponse(
+			errors.New("client_id must be the name of a UAA client"),
+			http.StatusBadRequest, "invalid-client-id",
+		)
+	}
+
+	return clientID, nil
+}
+
+// inlineCredentials returns the current value of a credential as the
+// credentials of a service key. Values that are not objects are returned
+// under their credential type, such as password.
+func (credhubServiceBroker *CredhubServiceBroker) inlineCredentials(key string) (brokerapi.Binding, error) {
+	cred, err := credhubServiceBroker.Store.GetLatestVersion(key)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	if value, ok := cred.Value.(map[string]interface{}); ok {
+		return brokerapi.Binding{Credentials: value}, nil
+	}
+
+	return brokerapi.Binding{Credentials: map[string]interface{}{cred.Type: cred.Value}}, nil
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func serviceKeyDetails(planID, rawParameters string) brokerapi.BindDetails {
+	return brokerapi.BindDetails{
+		ServiceID:     ServiceID,
+		PlanID:        planID,
+		RawParameters: json.RawMessage(rawParameters),
+	}
+}
+
+func TestServiceKeysAreGrantedToAUAAClient(t *testing.T) {
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	for _, test := range []struct {
+		name     string
+		details  brokerapi.BindDetails
+		actor    string
+		status   int
+		errorKey string
+	}{
+		{"client_id parameter", serviceKeyDetails(PlanNameDefault, `{"client_id":"reporting"}`), "uaa-client:reporting", 0, ""},
+		{"client id of the bind resource", brokerapi.BindDetails{ServiceID: ServiceID, PlanID: PlanNameDefault, BindResource: &brokerapi.BindResource{CredentialClientID: "reporting"}}, "uaa-client:reporting", 0, ""},
+		{"app guid of the bind resource", brokerapi.BindDetails{ServiceID: ServiceID, PlanID: PlanNameDefault, BindResource: &brokerapi.BindResource{AppGuid: "app-guid"}}, "mtls-app:app-guid", 0, ""},
+		{"no app guid or client id", serviceKeyDetails(PlanNameDefault, ``), "", http.StatusUnprocessableEntity, "missing-binding-actor"},
+		{"parameters without client_id", serviceKeyDetails(PlanNameDefault, `{"operations":["read"]}`), "", http.StatusUnprocessableEntity, "missing-binding-actor"},
+		{"empty client_id", serviceKeyDetails(PlanNameDefault, `{"client_id":""}`), "", http.StatusBadRequest, "invalid-client-id"},
+		{"client_id that is not a string", serviceKeyDetails(PlanNameDefault, `{"client_id":["reporting"]}`), "", http.StatusBadRequest, "invalid-client-id"},
+		{"parameters that are not an object", serviceKeyDetails(PlanNameDefault, `["reporting"]`), "", brokerapi.ErrRawParamsInvalid.ValidatedStatusCode(nil), ""},
+	} {
+		credStore := store.NewMemoryStore()
+		broker := newTestBroker(credStore)
+		if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+			t.Fatal(err)
+		}
+
+		binding, err := broker.Bind(context.Background(), "instance", "service-key", test.details)
+		if test.status != 0 {
+			if status := failureStatus(t, err); status != test.status {
+				t.Errorf("%s: expected status %d, got %d", test.name, test.status, status)
+			}
+			if test.errorKey != "" && err.(*brokerapi.FailureResponse).LoggerAction() != test.errorKey {
+				t.Errorf("%s: expected error %s, got %s", test.name, test.errorKey, err.(*brokerapi.FailureResponse).LoggerAction())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+
+		if expected := credhubRef(key).Credentials; !reflect.DeepEqual(binding.Credentials, expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, expected, binding.Credentials)
+		}
+		perms, err := credStore.GetPermissions(key)
+		if err != nil || len(perms) != 1 || perms[0].Actor != test.actor {
+			t.Errorf("%s: expected %s to be granted access, got %v and %v", test.name, test.actor, perms, err)
+		}
+	}
+}
+
+func TestInlineServiceKeysReturnTheCredentialValue(t *testing.T) {
+	for _, test := range []struct {
+		planID, parameters string
+		check              func(credentials map[string]interface{}) bool
+	}{
+		{PlanNameDefault, `{"password":"secret","port":5432}`, func(credentials map[string]interface{}) bool {
+			return reflect.DeepEqual(credentials, map[string]interface{}{"password": "secret", "port": float64(5432)})
+		}},
+		{"password", `{"length":20}`, func(credentials map[string]interface{}) bool {
+			password, ok := credentials["password"].(string)
+			return ok && len(credentials) == 1 && len(password) == 20
+		}},
+	} {
+		credStore := store.NewMemoryStore()
+		broker := newTestBroker(credStore)
+		key := constructKey(ServiceID, "instance", CredentialsID)
+		for i := range broker.Catalog.Services[0].Plans {
+			broker.Catalog.Services[0].Plans[i].InlineServiceKeys = true
+		}
+
+		if _, err := broker.Provision(context.Background(), "instance", provisionDetails(test.planID, test.parameters), false); err != nil {
+			t.Fatal(err)
+		}
+		binding, err := broker.Bind(context.Background(), "instance", "service-key", serviceKeyDetails(test.planID, ``))
+		if err != nil {
+			t.Fatalf("%s: %s", test.planID, err)
+		}
+
+		credentials, ok := binding.Credentials.(map[string]interface{})
+		if !ok || !test.check(credentials) {
+			t.Errorf("%s: unexpected inline credentials %#v", test.planID, binding.Credentials)
+		}
+		if perms, err := credStore.GetPermissions(key); err != nil || len(perms) != 0 {
+			t.Errorf("%s: expected no access to be granted, got %v and %v", test.planID, perms, err)
+		}
+
+		// a repeated request answers with the same shape
+		repeated, err := broker.Bind(context.Background(), "instance", "service-key", serviceKeyDetails(test.planID, ``))
+		if err != nil || !reflect.DeepEqual(repeated.Credentials, binding.Credentials) {
+			t.Errorf("%s: expected the repeated bind to return %v, got %v and %v", test.planID, binding.Credentials, repeated.Credentials, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// SharingOrganization limits bindings of a shared instance to apps in the
+// organization that owns it.
+const SharingOrganization = "org"
+
+func validateSharing(plan Plan) error {
+	switch plan.Sharing {
+	case "", SharingOrganization:
+		return nil
+	}
+
+	return fmt.Errorf("has unknown sharing policy %q, expected %s", plan.Sharing, SharingOrganization)
+}
+
+// checkSharing enforces the plan's sharing policy on a binding. A binding
+// is refused when the instance or the binding request does not say which
+// organization it belongs to, as it cannot be shown to be in the same one.
+func checkSharing(plan Plan, instance instanceMetadata, context platformContext) error {
+	if plan.Sharing != SharingOrganization {
+		return nil
+	}
+
+	switch {
+	case instance.OrganizationGUID == "":
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("plan %q only allows bindings from the organization that owns the service instance, which was not recorded", plan.Name),
+			http.StatusForbidden, "sharing-not-allowed",
+		)
+	case context.OrganizationGUID == "":
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("plan %q only allows bindings from the organization that owns the service instance, the binding request has no organization_guid in its context", plan.Name),
+			http.StatusForbidden, "sharing-not-allowed",
+		)
+	case instance.OrganizationGUID != context.OrganizationGUID:
+		return brokerapi.NewFailureResponse(
+			fmt.Errorf("plan %q only allows bindings from the organization that owns the service instance", plan.Name),
+			http.StatusForbidden, "sharing-not-allowed",
+		)
+	}
+
+	return nil
+}
+
+// InstanceBinding describes a binding of an instance and the space it was
+// made from.
+type InstanceBinding struct {
+	BindingID        string `json:"binding_id"`
+	Actor            string `json:"actor,omitempty"`
+	AppGUID          string `json:"app_guid,omitempty"`
+	OrganizationGUID string `json:"organization_guid,omitempty"`
+	SpaceGUID        string `json:"space_guid,omitempty"`
+	Shared           bool   `json:"shared"`
+	CreatedAt        string `json:"created_at,omitempty"`
+}
+
+// InstanceBindings lists an instance's bindings along with the spaces other
+// than its own that hold them.
+type InstanceBindings struct {
+	OrganizationGUID string            `json:"organization_guid,omitempty"`
+	SpaceGUID        string            `json:"space_guid,omitempty"`
+	SharedSpaces     []string          `json:"shared_spaces"`
+	Bindings         []InstanceBinding `json:"bindings"`
+}
+
+func (credhubServiceBroker *CredhubServiceBroker) InstanceBindings(serviceID, instanceID string) (InstanceBindings, error) {
+	instance, exists, err := credhubServiceBroker.readInstance(serviceID, instanceID)
+	if err != nil {
+		return InstanceBindings{}, err
+	}
+	if !exists {
+		return InstanceBindings{}, store.ErrNotFound
+	}
+
+	records, err := credhubServiceBroker.bindingRecords(serviceID, instanceID)
+	if err != nil {
+		return InstanceBindings{}, err
+	}
+
+	bindings := InstanceBindings{
+		OrganizationGUID: instance.OrganizationGUID,
+		SpaceGUID:        instance.SpaceGUID,
+		SharedSpaces:     []string{},
+		Bindings:         []InstanceBinding{},
+	}
+	sharedSpaces := map[string]bool{}
+
+	for _, binding := range records {
+		shared := binding.SpaceGUID != "" && instance.SpaceGUID != "" && binding.SpaceGUID != instance.SpaceGUID
+		if shared {
+			sharedSpaces[binding.SpaceGUID] = true
+		}
+
+		bindings.Bindings = append(bindings.Bindings, InstanceBinding{
+			BindingID:        binding.id,
+			Actor:            binding.Actor,
+			AppGUID:          binding.AppGUID,
+			OrganizationGUID: binding.OrganizationGUID,
+			SpaceGUID:        binding.SpaceGUID,
+			Shared:           shared,
+			CreatedAt:        binding.CreatedAt,
+		})
+	}
+
+	for space := range sharedSpaces {
+		bindings.SharedSpaces = append(bindings.SharedSpaces, space)
+	}
+	sort.Strings(bindings.SharedSpaces)
+
+	return bindings, nil
+}
+
+// instanceBindingRecord is a binding record along with its binding ID.
+type instanceBindingRecord struct {
+	bindingRecord
+	id string
+}
+
+// bindingRecords reads the records of an instance's bindings, which are
+// stored beside the instance's own records.
+func (credhubServiceBroker *CredhubServiceBroker) bindingRecords(serviceID, instanceID string) ([]instanceBindingRecord, error) {
+	instancePath := constructKey(serviceID, instanceID, "")
+	results, err := credhubServiceBroker.Store.FindByPath(instancePath)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []instanceBindingRecord{}
+	for _, credential := range results.Credentials {
+		leaf := strings.TrimPrefix(credential.Name, instancePath)
+		if strings.Contains(leaf, "/") || reservedBindingID(leaf) {
+			continue
+		}
+
+		binding, err := readBinding(credhubServiceBroker.Store, credential.Name)
+		if err == store.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, instanceBindingRecord{bindingRecord: binding, id: leaf})
+	}
+
+	return records, nil
+}
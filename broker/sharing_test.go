@@ -0,0 +1,75 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func newSharingBroker(t *testing.T) *CredhubServiceBroker {
+	broker := newTestBroker(store.NewMemoryStore())
+	broker.Catalog.Services[0].Plans[0].Sharing = SharingOrganization
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func bindDetails(rawContext string) brokerapi.BindDetails {
+	return brokerapi.BindDetails{
+		ServiceID:  ServiceID,
+		PlanID:     PlanNameDefault,
+		AppGUID:    "app-guid",
+		RawContext: json.RawMessage(rawContext),
+	}
+}
+
+func TestSharingAllowsBindingsFromTheSameOrganization(t *testing.T) {
+	broker := newSharingBroker(t)
+
+	_, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(`{"platform":"cloudfoundry","organization_guid":"org-guid","space_guid":"other-space"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSharingRefusesBindingsFromAnotherOrganization(t *testing.T) {
+	broker := newSharingBroker(t)
+
+	_, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(`{"platform":"cloudfoundry","organization_guid":"other-org"}`))
+	if status := failureStatus(t, err); status != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, status)
+	}
+}
+
+func TestSharingRefusesBindingsWithoutContext(t *testing.T) {
+	broker := newSharingBroker(t)
+
+	for _, rawContext := range []string{``, `{"platform":"cloudfoundry"}`} {
+		_, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(rawContext))
+		if status := failureStatus(t, err); status != http.StatusForbidden {
+			t.Errorf("expected %d for context %q, got %d", http.StatusForbidden, rawContext, status)
+		}
+	}
+}
+
+func TestSharingRefusesBindingsToInstancesWithoutAnOrganization(t *testing.T) {
+	broker := newTestBroker(store.NewMemoryStore())
+	broker.Catalog.Services[0].Plans[0].Sharing = SharingOrganization
+
+	details := provisionDetails(PlanNameDefault, `{"password":"secret"}`)
+	details.OrganizationGUID = ""
+	if _, err := broker.Provision(context.Background(), "instance", details, false); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := broker.Bind(context.Background(), "instance", "binding", bindDetails(`{"platform":"cloudfoundry","organization_guid":"org-guid"}`))
+	if status := failureStatus(t, err); status != http.StatusForbidden {
+		t.Errorf("expected %d, got %d", http.StatusForbidden, status)
+	}
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"code.cloudfoundry.org/lager"
+)
+
+// step is a single change made by a transaction. undo reverts a completed do
+// and may be nil when there is nothing to compensate.
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// transaction runs a sequence of steps against the store. When a step fails
+// the steps that already completed are undone in reverse order, so the store
+// is left as it was before the transaction started.
+type transaction struct {
+	logger lager.Logger
+	steps  []step
+}
+
+func newTransaction(logger lager.Logger) *transaction {
+	return &transaction{logger: logger}
+}
+
+func (transaction *transaction) add(name string, do func() error, undo func() error) {
+	transaction.steps = append(transaction.steps, step{name: name, do: do, undo: undo})
+}
+
+func (transaction *transaction) run() error {
+	for i, step := range transaction.steps {
+		transaction.logger.Debug("running-step", lager.Data{"step": step.name})
+		if err := step.do(); err != nil {
+			transaction.logger.Error("step-failed", err, lager.Data{"step": step.name})
+			transaction.rollback(transaction.steps[:i])
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (transaction *transaction) rollback(completed []step) {
+	for i := len(completed) - 1; i >= 0; i-- {
+		step := completed[i]
+		if step.undo == nil {
+			continue
+		}
+
+		transaction.logger.Info("undoing-step", lager.Data{"step": step.name})
+		if err := step.undo(); err != nil {
+			transaction.logger.Error("undo-failed", err, lager.Data{"step": step.name})
+		}
+	}
+}
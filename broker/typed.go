@@ -0,0 +1,369 @@
+package broker
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// CredentialTypeParameter selects the CredHub type used to store provision
+// and update parameters. Without it the parameters are stored as a json
+// credential. With it the credential itself is given in the value parameter,
+// for example:
+//
+//	{"credential_type": "user", "value": {"username": "admin", "password": "secret"}}
+const CredentialTypeParameter = "credential_type"
+
+const credentialValueParameter = "value"
+
+// parseCredentials validates user-provided parameters and returns the
+// CredHub type and value they should be stored as.
+func parseCredentials(rawParameters json.RawMessage) (string, interface{}, error) {
+	var parameters map[string]json.RawMessage
+	if err := json.Unmarshal(rawParameters, &parameters); err != nil {
+		return "", nil, brokerapi.ErrRawParamsInvalid
+	}
+
+	rawType, ok := parameters[CredentialTypeParameter]
+	if !ok {
+		var credentials map[string]interface{}
+		if err := json.Unmarshal(rawParameters, &credentials); err != nil {
+			return "", nil, brokerapi.ErrRawParamsInvalid
+		}
+		return "json", values.JSON(credentials), nil
+	}
+
+	var credType string
+	if err := json.Unmarshal(rawType, &credType); err != nil {
+		return "", nil, invalidCredential("%s must be a string", CredentialTypeParameter)
+	}
+
+	if credType == "json" {
+		delete(parameters, CredentialTypeParameter)
+		credentials := values.JSON{}
+		for name, rawValue := range parameters {
+			var value interface{}
+			if err := json.Unmarshal(rawValue, &value); err != nil {
+				return "", nil, brokerapi.ErrRawParamsInvalid
+			}
+			credentials[name] = value
+		}
+		return credType, credentials, nil
+	}
+
+	for name := range parameters {
+		if name != CredentialTypeParameter && name != credentialValueParameter {
+			return "", nil, invalidCredential("unexpected parameter %q for a %s credential, the credential belongs in %q", name, credType, credentialValueParameter)
+		}
+	}
+
+	rawValue, ok := parameters[credentialValueParameter]
+	if !ok {
+		return "", nil, invalidCredential("a %s credential requires the %q parameter", credType, credentialValueParameter)
+	}
+
+	switch credType {
+	case "password":
+		var value values.Password
+		if err := decodeCredential(credType, rawValue, &value); err != nil {
+			return "", nil, err
+		}
+		if value == "" {
+			return "", nil, invalidCredential("a password credential cannot be empty")
+		}
+		return credType, value, nil
+
+	case "user":
+		var value values.User
+		if err := decodeCredential(credType, rawValue, &value); err != nil {
+			return "", nil, err
+		}
+		if value.Password == "" {
+			return "", nil, invalidCredential("a user credential requires a password")
+		}
+		return credType, value, nil
+
+	case "certificate":
+		var value values.Certificate
+		if err := decodeCredential(credType, rawValue, &value); err != nil {
+			return "", nil, err
+		}
+		if err := validateCertificate(value); err != nil {
+			return "", nil, invalidCredential("invalid certificate credential: %s", err)
+		}
+		return credType, value, nil
+
+	case "rsa":
+		var value values.RSA
+		if err := decodeCredential(credType, rawValue, &value); err != nil {
+			return "", nil, err
+		}
+		if err := validateRSA(value); err != nil {
+			return "", nil, invalidCredential("invalid rsa credential: %s", err)
+		}
+		return credType, value, nil
+
+	case "ssh":
+		var value values.SSH
+		if err := decodeCredential(credType, rawValue, &value); err != nil {
+			return "", nil, err
+		}
+		if err := validateSSH(value); err != nil {
+			return "", nil, invalidCredential("invalid ssh credential: %s", err)
+		}
+		return credType, value, nil
+	}
+
+	return "", nil, invalidCredential("unsupported %s %q, expected one of json, password, user, certificate, rsa or ssh", CredentialTypeParameter, credType)
+}
+
+// setCredential stores a value returned by parseCredentials with the
+// matching CredHub call.
+func (credhubServiceBroker *CredhubServiceBroker) setCredential(key, credType string, value interface{}) (err error) {
+	mode := credhub.Overwrite
+
+	switch value := value.(type) {
+	case values.JSON:
+		_, err = credhubServiceBroker.Store.SetJSON(key, value, mode)
+	case values.Password:
+		_, err = credhubServiceBroker.Store.SetPassword(key, value, mode)
+	case values.User:
+		_, err = credhubServiceBroker.Store.SetUser(key, value, mode)
+	case values.Certificate:
+		_, err = credhubServiceBroker.Store.SetCertificate(key, value, mode)
+	case values.RSA:
+		_, err = credhubServiceBroker.Store.SetRSA(key, value, mode)
+	case values.SSH:
+		_, err = credhubServiceBroker.Store.SetSSH(key, value, mode)
+	default:
+		return fmt.Errorf("unsupported credential value %T", value)
+	}
+
+	if err != nil {
+		credhubServiceBroker.Logger.Error("unable to store user-provided credentials to credhub ", err, map[string]interface{}{"key": key, "type": credType})
+		if err == store.ErrTypeModified {
+			return brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "credential-type-modified")
+		}
+		// left for the broker API methods to answer with a 503
+		if store.IsTransient(err) {
+			return err
+		}
+		return brokerapi.NewFailureResponse(err, http.StatusInternalServerError, "unable to store the user-provided credentials")
+	}
+
+	return nil
+}
+
+func decodeCredential(credType string, rawValue json.RawMessage, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(rawValue))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		return invalidCredential("invalid %s credential: %s", credType, err)
+	}
+	return nil
+}
+
+func invalidCredential(format string, args ...interface{}) error {
+	return brokerapi.NewFailureResponse(fmt.Errorf(format, args...), http.StatusBadRequest, "invalid-credential")
+}
+
+func validateCertificate(value values.Certificate) error {
+	if value.Certificate == "" || value.PrivateKey == "" {
+		return errors.New("certificate and private_key are required")
+	}
+
+	certificate, err := parseCertificate(value.Certificate)
+	if err != nil {
+		return fmt.Errorf("certificate: %s", err)
+	}
+
+	privateKey, err := parsePrivateKey(value.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private_key: %s", err)
+	}
+
+	if !samePublicKey(certificate.PublicKey, privateKey.Public()) {
+		return errors.New("private_key does not match the certificate")
+	}
+
+	if value.Ca != "" {
+		ca, err := parseCertificate(value.Ca)
+		if err != nil {
+			return fmt.Errorf("ca: %s", err)
+		}
+		if err := certificate.CheckSignatureFrom(ca); err != nil {
+			return fmt.Errorf("certificate is not signed by the ca: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func validateRSA(value values.RSA) error {
+	if value.PublicKey == "" || value.PrivateKey == "" {
+		return errors.New("public_key and private_key are required")
+	}
+
+	privateKey, err := parsePrivateKey(value.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private_key: %s", err)
+	}
+	if _, ok := privateKey.(*rsa.PrivateKey); !ok {
+		return errors.New("private_key is not an RSA key")
+	}
+
+	block, _ := pem.Decode([]byte(value.PublicKey))
+	if block == nil {
+		return errors.New("public_key is not PEM encoded")
+	}
+
+	var publicKey interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		publicKey, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("public_key: %s", err)
+	}
+
+	if !samePublicKey(publicKey, privateKey.Public()) {
+		return errors.New("private_key does not match the public_key")
+	}
+
+	return nil
+}
+
+func validateSSH(value values.SSH) error {
+	if value.PublicKey == "" || value.PrivateKey == "" {
+		return errors.New("public_key and private_key are required")
+	}
+
+	fields := strings.Fields(value.PublicKey)
+	if len(fields) < 2 {
+		return errors.New("public_key must be in OpenSSH format")
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return errors.New("public_key must be in OpenSSH format")
+	}
+
+	wire, err := sshWireStrings(blob)
+	if err != nil || len(wire) == 0 || string(wire[0]) != fields[0] {
+		return errors.New("public_key must be in OpenSSH format")
+	}
+
+	if block, _ := pem.Decode([]byte(value.PrivateKey)); block == nil {
+		return errors.New("private_key is not PEM encoded")
+	}
+
+	// only RSA keys can be compared without an SSH library, other key types
+	// are accepted once their encoding is valid
+	if fields[0] != "ssh-rsa" {
+		return nil
+	}
+
+	privateKey, err := parsePrivateKey(value.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("private_key: %s", err)
+	}
+
+	rsaKey, ok := privateKey.(*rsa.PrivateKey)
+	if !ok || len(wire) != 3 {
+		return errors.New("private_key does not match the public_key")
+	}
+
+	e := new(big.Int).SetBytes(wire[1])
+	n := new(big.Int).SetBytes(wire[2])
+	if n.Cmp(rsaKey.N) != 0 || e.Int64() != int64(rsaKey.E) {
+		return errors.New("private_key does not match the public_key")
+	}
+
+	return nil
+}
+
+func parseCertificate(certificatePEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("not a PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(privateKeyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, errors.New("not a PEM encoded private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("unsupported private key format")
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type, expected an RSA, ECDSA or Ed25519 key")
+}
+
+func samePublicKey(a, b interface{}) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aDER, bDER)
+}
+
+// sshWireStrings splits an OpenSSH public key blob into its length-prefixed
+// fields.
+func sshWireStrings(blob []byte) ([][]byte, error) {
+	fields := [][]byte{}
+	for len(blob) > 0 {
+		if len(blob) < 4 {
+			return nil, errors.New("truncated key")
+		}
+		length := binary.BigEndian.Uint32(blob)
+		blob = blob[4:]
+		if uint32(len(blob)) < length {
+			return nil, errors.New("truncated key")
+		}
+		fields = append(fields, blob[:length])
+		blob = blob[length:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,214 @@
+package broker
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+func encodePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	return string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}))
+}
+
+func pkcs8PEM(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encodePEM(t, "PRIVATE KEY", der)
+}
+
+// newCertificate returns a PEM certificate for key, signed by parent and
+// parentKey or self-signed when parent is nil.
+func newCertificate(t *testing.T, key crypto.Signer, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, string) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, encodePEM(t, "CERTIFICATE", der)
+}
+
+// sshPublicKey encodes an OpenSSH public key from its wire format fields.
+func sshPublicKey(keyType string, fields ...[]byte) string {
+	blob := []byte{}
+	for _, field := range append([][]byte{[]byte(keyType)}, fields...) {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		blob = append(append(blob, length...), field...)
+	}
+	return keyType + " " + base64.StdEncoding.EncodeToString(blob) + " test"
+}
+
+func sshRSAPublicKey(key *rsa.PublicKey) string {
+	// mpints with the high bit set are prefixed with a zero byte
+	return sshPublicKey("ssh-rsa", big.NewInt(int64(key.E)).Bytes(), append([]byte{0}, key.N.Bytes()...))
+}
+
+func credentialParameters(t *testing.T, credType string, value interface{}) string {
+	t.Helper()
+	parameters, err := json.Marshal(map[string]interface{}{CredentialTypeParameter: credType, "value": value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(parameters)
+}
+
+func TestParseCredentials(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Public, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKIX, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaPEM := encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	otherRSAPEM := encodePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(otherRSAKey))
+	ecdsaPEM := encodePEM(t, "EC PRIVATE KEY", ecDER)
+
+	ca, caPEM := newCertificate(t, rsaKey, nil, nil)
+	_, rsaCertificatePEM := newCertificate(t, otherRSAKey, ca, rsaKey)
+	_, ecdsaCertificatePEM := newCertificate(t, ecdsaKey, nil, nil)
+	_, ed25519CertificatePEM := newCertificate(t, ed25519Key, nil, nil)
+	_, otherCAPEM := newCertificate(t, ecdsaKey, nil, nil)
+
+	for _, test := range []struct {
+		name       string
+		parameters string
+		credType   string
+	}{
+		{"json without a type", `{"password":"secret","port":5432}`, "json"},
+		{"json", `{"credential_type":"json","password":"secret"}`, "json"},
+		{"password", credentialParameters(t, "password", "secret"), "password"},
+		{"user", credentialParameters(t, "user", values.User{Username: "admin", Password: "secret"}), "user"},
+		{"rsa certificate with its ca", credentialParameters(t, "certificate", values.Certificate{Ca: caPEM, Certificate: rsaCertificatePEM, PrivateKey: otherRSAPEM}), "certificate"},
+		{"ecdsa certificate", credentialParameters(t, "certificate", values.Certificate{Certificate: ecdsaCertificatePEM, PrivateKey: ecdsaPEM}), "certificate"},
+		{"pkcs8 ecdsa certificate", credentialParameters(t, "certificate", values.Certificate{Certificate: ecdsaCertificatePEM, PrivateKey: pkcs8PEM(t, ecdsaKey)}), "certificate"},
+		{"ed25519 certificate", credentialParameters(t, "certificate", values.Certificate{Certificate: ed25519CertificatePEM, PrivateKey: pkcs8PEM(t, ed25519Key)}), "certificate"},
+		{"rsa with a pkcs1 public key", credentialParameters(t, "rsa", values.RSA{PublicKey: encodePEM(t, "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)), PrivateKey: rsaPEM}), "rsa"},
+		{"rsa with a pkix public key", credentialParameters(t, "rsa", values.RSA{PublicKey: encodePEM(t, "PUBLIC KEY", rsaPKIX), PrivateKey: pkcs8PEM(t, rsaKey)}), "rsa"},
+		{"ssh-rsa", credentialParameters(t, "ssh", values.SSH{PublicKey: sshRSAPublicKey(&rsaKey.PublicKey), PrivateKey: rsaPEM}), "ssh"},
+		{"ssh-ed25519", credentialParameters(t, "ssh", values.SSH{PublicKey: sshPublicKey("ssh-ed25519", ed25519Public), PrivateKey: encodePEM(t, "OPENSSH PRIVATE KEY", []byte("key"))}), "ssh"},
+	} {
+		credType, _, err := parseCredentials(json.RawMessage(test.parameters))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if credType != test.credType {
+			t.Errorf("%s: expected type %s, got %s", test.name, test.credType, credType)
+		}
+	}
+
+	for _, test := range []struct {
+		name       string
+		parameters string
+	}{
+		{"unknown credential_type", `{"credential_type":"secret","value":"x"}`},
+		{"credential_type that is not a string", `{"credential_type":1,"value":"x"}`},
+		{"missing value", `{"credential_type":"password"}`},
+		{"parameters beside the value", `{"credential_type":"password","value":"secret","other":1}`},
+		{"empty password", credentialParameters(t, "password", "")},
+		{"user without a password", credentialParameters(t, "user", values.User{Username: "admin"})},
+		{"unknown value field", `{"credential_type":"user","value":{"username":"admin","password":"secret","role":"admin"}}`},
+		{"mismatched certificate and key", credentialParameters(t, "certificate", values.Certificate{Certificate: rsaCertificatePEM, PrivateKey: rsaPEM})},
+		{"certificate not signed by its ca", credentialParameters(t, "certificate", values.Certificate{Ca: otherCAPEM, Certificate: rsaCertificatePEM, PrivateKey: otherRSAPEM})},
+		{"certificate that is not PEM", credentialParameters(t, "certificate", values.Certificate{Certificate: "certificate", PrivateKey: otherRSAPEM})},
+		{"private key that is not PEM", credentialParameters(t, "certificate", values.Certificate{Certificate: rsaCertificatePEM, PrivateKey: "key"})},
+		{"certificate without a key", credentialParameters(t, "certificate", values.Certificate{Certificate: rsaCertificatePEM})},
+		{"mismatched rsa keys", credentialParameters(t, "rsa", values.RSA{PublicKey: encodePEM(t, "PUBLIC KEY", rsaPKIX), PrivateKey: otherRSAPEM})},
+		{"rsa with an ecdsa key", credentialParameters(t, "rsa", values.RSA{PublicKey: encodePEM(t, "PUBLIC KEY", rsaPKIX), PrivateKey: ecdsaPEM})},
+		{"rsa public key that is not PEM", credentialParameters(t, "rsa", values.RSA{PublicKey: "key", PrivateKey: rsaPEM})},
+		{"mismatched ssh-rsa keys", credentialParameters(t, "ssh", values.SSH{PublicKey: sshRSAPublicKey(&rsaKey.PublicKey), PrivateKey: otherRSAPEM})},
+		{"ssh public key that is not OpenSSH", credentialParameters(t, "ssh", values.SSH{PublicKey: "ssh-rsa not-base64", PrivateKey: rsaPEM})},
+		{"ssh key type that does not match the blob", credentialParameters(t, "ssh", values.SSH{PublicKey: "ssh-ed25519" + sshRSAPublicKey(&rsaKey.PublicKey)[len("ssh-rsa"):], PrivateKey: rsaPEM})},
+	} {
+		_, _, err := parseCredentials(json.RawMessage(test.parameters))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+			continue
+		}
+		if status := failureStatus(t, err); status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", test.name, status)
+		}
+	}
+}
+
+func TestProvisionStoresTypedCredentials(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	key := constructKey(ServiceID, "instance", CredentialsID)
+
+	parameters := credentialParameters(t, "user", values.User{Username: "admin", Password: "secret"})
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, parameters), false); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := credStore.GetLatestVersion(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Type != "user" {
+		t.Errorf("expected a user credential, got %s", cred.Type)
+	}
+
+	// CredHub keeps the type of a credential for as long as it exists
+	_, err = broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, credentialParameters(t, "password", "secret")), false)
+	if status := failureStatus(t, err); status != http.StatusUnprocessableEntity {
+		t.Errorf("expected changing the type to answer 422, got %d", status)
+	}
+}
@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// prepareUpdate returns the work for an update request: restoring an earlier
+// version, patching, rotating generated credentials, or writing new ones. It
+// returns nil when there is nothing to do. Bindings holding a copy of the
+// instance's credential are given its new value, rotation already does so.
+func (credhubServiceBroker *CredhubServiceBroker) prepareUpdate(plan Plan, instanceID string, details brokerapi.UpdateDetails) (func() error, error) {
+	key := constructKey(details.ServiceID, instanceID, CredentialsID)
+
+	restore, ok, err := restoreParameter(details.RawParameters)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		// CredHub cannot reinstate a generated version, writing its value
+		// back would stop the credential from being rotated
+		if plan.Generate != "" {
+			return nil, brokerapi.NewFailureResponse(
+				fmt.Errorf("plan %q generates its credentials, they can be rotated but not restored", plan.Name),
+				http.StatusUnprocessableEntity, "restore-not-supported",
+			)
+		}
+		write, err := credhubServiceBroker.prepareRestore(key, restore)
+		return credhubServiceBroker.thenCopyToBindings(plan, details.ServiceID, instanceID, write), err
+	}
+
+	mode, patch, parameters, err := updateModeParameter(details.RawParameters)
+	if err != nil {
+		return nil, err
+	}
+	if mode != UpdateModeReplace {
+		write, err := credhubServiceBroker.preparePatch(plan, key, mode, patch)
+		return credhubServiceBroker.thenCopyToBindings(plan, details.ServiceID, instanceID, write), err
+	}
+
+	rotate, ok, err := rotateParameter(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if ok && !rotate {
+		return nil, nil
+	}
+	if rotate {
+		// a plan that stores user-provided credentials has nothing to
+		// rotate unless its bindings get generated credentials of their own
+		if plan.Generate == "" && plan.BindingCredentials != BindingCredentialsGenerate {
+			return nil, brokerapi.NewFailureResponse(
+				fmt.Errorf("plan %q stores user-provided credentials, they can be updated but not rotated", plan.Name),
+				http.StatusUnprocessableEntity, "rotation-not-supported",
+			)
+		}
+		return func() error {
+			return credhubServiceBroker.rotateInstance(plan, details.ServiceID, instanceID)
+		}, nil
+	}
+
+	// restore, rotate and update_mode are the broker's own parameters, not the plan's
+	if err := validateParameters(plan, instanceUpdateSchema, parameters); err != nil {
+		return nil, err
+	}
+
+	write, err := credhubServiceBroker.prepareCredentials(plan, parameters, key)
+	return credhubServiceBroker.thenCopyToBindings(plan, details.ServiceID, instanceID, write), err
+}
+
+// thenCopyToBindings returns write followed by copying the instance's new
+// credential to the bindings that hold a copy of it.
+func (credhubServiceBroker *CredhubServiceBroker) thenCopyToBindings(plan Plan, serviceID, instanceID string, write func() error) func() error {
+	if write == nil {
+		return nil
+	}
+
+	return func() error {
+		if err := write(); err != nil {
+			return err
+		}
+		return credhubServiceBroker.copyToBindings(plan, serviceID, instanceID)
+	}
+}
@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestUpdateWithoutParametersKeepsUserProvidedCredentials(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	other := broker.Catalog.Services[0].Plans[0]
+	other.ID, other.Name = "other", "other"
+	broker.Catalog.Services[0].Plans = append(broker.Catalog.Services[0].Plans, other)
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"secret"}`), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, ``), false); err != nil {
+		t.Fatalf("expected an update without parameters to succeed, got %s", err)
+	}
+
+	details := updateDetails("other", ``)
+	details.PreviousValues = brokerapi.PreviousValues{PlanID: PlanNameDefault}
+	if _, err := broker.Update(context.Background(), "instance", details, false); err != nil {
+		t.Fatalf("expected a plan change to succeed, got %s", err)
+	}
+
+	cred, err := credStore.GetLatestJSON(constructKey(ServiceID, "instance", CredentialsID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Value["password"] != "secret" {
+		t.Errorf("expected the credentials to be kept, got %v", cred.Value)
+	}
+
+	metadata, _, err := broker.readInstance(ServiceID, "instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.PlanID != "other" {
+		t.Errorf("expected the instance to be on plan other, got %q", metadata.PlanID)
+	}
+}
+
+func TestUpdateCopiesNewCredentialsToBindings(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	broker := newTestBroker(credStore)
+	broker.Catalog.Services[0].Plans[0].BindingCredentials = BindingCredentialsCopy
+	broker.KubernetesRules = []KubernetesRule{{Actor: "k8s:{namespace}", Path: "/k8s/{namespace}/{binding_id}"}}
+
+	if _, err := broker.Provision(context.Background(), "instance", provisionDetails(PlanNameDefault, `{"password":"first"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Bind(context.Background(), "instance", "app-binding", bindDetails(``)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broker.Bind(context.Background(), "instance", "k8s-binding", bindDetails(`{"platform":"kubernetes","namespace":"ns"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name, parameters, password string
+	}{
+		{"replace", `{"password":"second"}`, "second"},
+		{"merge patch", `{"update_mode":"merge-patch","patch":{"password":"third"}}`, "third"},
+		{"restore", `{"restore":{"index":2}}`, "first"},
+	} {
+		if _, err := broker.Update(context.Background(), "instance", updateDetails(PlanNameDefault, test.parameters), false); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		for _, key := range []string{bindingCredentialsKey(ServiceID, "instance", "app-binding"), "/k8s/ns/k8s-binding"} {
+			cred, err := credStore.GetLatestJSON(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cred.Value["password"] != test.password {
+				t.Errorf("%s: expected %s to hold %q, got %v", test.name, key, test.password, cred.Value)
+			}
+		}
+	}
+
+	// the copies keep the access granted at bind time
+	perms, err := credStore.GetPermissions(bindingCredentialsKey(ServiceID, "instance", "app-binding"))
+	if err != nil || len(perms) != 1 || perms[0].Actor != "mtls-app:app-guid" {
+		t.Errorf("expected the binding's permission to be kept, got %v and %v", perms, err)
+	}
+}
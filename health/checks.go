@@ -0,0 +1,76 @@
+package health
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/auth"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+// CredHubChecks confirm CredHub is reachable and that the broker can get a
+// UAA token when it authenticates with one.
+func CredHubChecks(credHubClient *credhub.CredHub) []Check {
+	return []Check{
+		{
+			Name: "credhub-info",
+			Run: func() error {
+				_, err := credHubClient.Info()
+				return err
+			},
+		},
+		{
+			Name: "credhub-version",
+			Run: func() error {
+				_, err := credHubClient.ServerVersion()
+				return err
+			},
+		},
+		{
+			Name: "uaa-token",
+			Run: func() error {
+				oauth, ok := credHubClient.Auth.(*auth.OAuthStrategy)
+				if !ok {
+					return nil
+				}
+				return oauth.Login()
+			},
+		},
+	}
+}
+
+// CanaryCheck writes, reads back and deletes a value below path, proving the
+// broker is authorized to manage credentials there. Each process uses its
+// own key so broker instances do not race each other.
+func CanaryCheck(credStore store.Store, path string) Check {
+	key := fmt.Sprintf("%s/canary-%s", path, randomID())
+
+	return Check{
+		Name: "credhub-canary",
+		Run: func() error {
+			value := randomID()
+			if _, err := credStore.SetValue(key, values.Value(value), credhub.Overwrite); err != nil {
+				return err
+			}
+
+			cred, err := credStore.GetLatestValue(key)
+			if err == nil && string(cred.Value) != value {
+				err = errors.New("canary value read back does not match the value written")
+			}
+
+			if deleteErr := credStore.Delete(key); err == nil {
+				err = deleteErr
+			}
+			return err
+		},
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,39 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ablease/credhub-broker/store"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+// readOnlyStore refuses writes, as CredHub does for a client without write
+// access to the broker's path.
+type readOnlyStore struct {
+	store.Store
+}
+
+func (readOnlyStore) SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error) {
+	return credentials.Value{}, errors.New("forbidden")
+}
+
+func TestCanaryCheck(t *testing.T) {
+	credStore := store.NewMemoryStore()
+	check := CanaryCheck(credStore, "/c/broker/health")
+
+	for i := 0; i < 2; i++ {
+		if err := check.Run(); err != nil {
+			t.Fatalf("run %d: expected the canary to pass, got %s", i, err)
+		}
+	}
+	if paths, err := credStore.FindAllPaths(); err != nil || len(paths.Paths) != 0 {
+		t.Errorf("expected the canary to be deleted, got %v and %v", paths, err)
+	}
+
+	if err := CanaryCheck(readOnlyStore{credStore}, "/c/broker/health").Run(); err == nil {
+		t.Error("expected the canary to fail when it cannot be written")
+	}
+}
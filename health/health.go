@@ -0,0 +1,130 @@
+// Package health serves liveness and readiness endpoints. Readiness runs a
+// set of checks against the broker's dependencies and caches the result.
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+)
+
+// DefaultCheckTimeout keeps a check that hangs, such as a request to an
+// unresponsive CredHub, from holding up the readiness probe.
+const DefaultCheckTimeout = 5 * time.Second
+
+type Check struct {
+	Name string
+	Run  func() error
+}
+
+type CheckResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+type Report struct {
+	Status    string        `json:"status"`
+	CheckedAt string        `json:"checked_at"`
+	Checks    []CheckResult `json:"checks"`
+}
+
+// Checker runs its checks at most once per TTL. A check that takes longer
+// than Timeout fails. Errors are logged rather than served, as the endpoints
+// are not authenticated.
+type Checker struct {
+	Checks  []Check
+	TTL     time.Duration
+	Timeout time.Duration
+	Logger  lager.Logger
+
+	mutex     sync.Mutex
+	report    Report
+	checkedAt time.Time
+}
+
+func NewChecker(ttl time.Duration, logger lager.Logger, checks ...Check) *Checker {
+	return &Checker{Checks: checks, TTL: ttl, Timeout: DefaultCheckTimeout, Logger: logger.Session("health")}
+}
+
+// Check returns the cached report, running the checks again once it is
+// older than the TTL. Concurrent callers wait for a single run.
+func (checker *Checker) Check() Report {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+
+	if !checker.checkedAt.IsZero() && time.Since(checker.checkedAt) < checker.TTL {
+		return checker.report
+	}
+
+	report := Report{Status: StatusOK, CheckedAt: time.Now().UTC().Format(time.RFC3339), Checks: []CheckResult{}}
+	for _, check := range checker.Checks {
+		start := time.Now()
+		err := checker.run(check)
+		result := CheckResult{Name: check.Name, Status: StatusOK, Duration: time.Since(start).Seconds()}
+		if err != nil {
+			checker.Logger.Error("check-failed", err, lager.Data{"check": check.Name})
+			result.Status = StatusFailing
+			report.Status = StatusFailing
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	checker.report = report
+	checker.checkedAt = time.Now()
+	return report
+}
+
+// run runs a check until it returns or Timeout passes. A check that timed
+// out is left to finish in the background.
+func (checker *Checker) run(check Check) error {
+	if checker.Timeout <= 0 {
+		return check.Run()
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- check.Run()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(checker.Timeout):
+		return errors.New("check timed out after " + checker.Timeout.String())
+	}
+}
+
+// ServeHTTP serves the readiness report, with 503 when any check fails.
+func (checker *Checker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	report := checker.Check()
+
+	status := http.StatusOK
+	if report.Status != StatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	respond(w, status, report)
+}
+
+// Liveness reports that the process is serving requests.
+func Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		respond(w, http.StatusOK, map[string]string{"status": StatusOK})
+	})
+}
+
+func respond(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,106 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func newTestChecker(checks ...Check) *Checker {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+	return NewChecker(0, logger, checks...)
+}
+
+func serve(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestReadinessFailsWhileLivenessPasses(t *testing.T) {
+	checker := newTestChecker(
+		Check{Name: "passing", Run: func() error { return nil }},
+		Check{Name: "failing", Run: func() error {
+			return errors.New("GET https://credhub.internal:8844/api/v1/data?name=/c/secret-value: password=hunter2")
+		}},
+	)
+
+	if status, _ := serve(t, Liveness(), "/healthz"); status != http.StatusOK {
+		t.Errorf("expected /healthz to answer 200, got %d", status)
+	}
+
+	status, body := serve(t, checker, "/readyz")
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected /readyz to answer 503, got %d", status)
+	}
+	for _, internal := range []string{"credhub.internal", "secret-value", "hunter2"} {
+		if strings.Contains(body, internal) {
+			t.Errorf("expected the response not to contain %q, got %s", internal, body)
+		}
+	}
+
+	var report Report
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, result := range report.Checks {
+		statuses[result.Name] = result.Status
+	}
+	if report.Status != StatusFailing || statuses["passing"] != StatusOK || statuses["failing"] != StatusFailing {
+		t.Errorf("expected only the failing check to fail, got %+v", report)
+	}
+}
+
+func TestReadinessPassesWhenEveryCheckPasses(t *testing.T) {
+	checker := newTestChecker(Check{Name: "passing", Run: func() error { return nil }})
+
+	if status, _ := serve(t, checker, "/readyz"); status != http.StatusOK {
+		t.Errorf("expected /readyz to answer 200, got %d", status)
+	}
+}
+
+func TestHangingCheckIsBoundedByTheTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	checker := newTestChecker(Check{Name: "hanging", Run: func() error {
+		<-release
+		return nil
+	}})
+	checker.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	report := checker.Check()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the check to stop waiting after its timeout, took %s", elapsed)
+	}
+	if report.Status != StatusFailing {
+		t.Errorf("expected a check that timed out to fail, got %+v", report)
+	}
+}
+
+func TestChecksRunOncePerTTL(t *testing.T) {
+	runs := 0
+	checker := newTestChecker(Check{Name: "counting", Run: func() error {
+		runs++
+		return nil
+	}})
+	checker.TTL = time.Hour
+
+	for i := 0; i < 3; i++ {
+		checker.Check()
+	}
+	if runs != 1 {
+		t.Errorf("expected the cached report to be served, got %d runs", runs)
+	}
+}
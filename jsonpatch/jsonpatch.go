@@ -0,0 +1,334 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to values decoded from JSON.
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Operation is a single JSON Patch operation.
+type Operation struct {
+	Op    string
+	Path  string
+	From  string
+	Value interface{}
+}
+
+// MergePatch applies an RFC 7396 merge patch. Members set to null in the
+// patch are removed from the target.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	result := map[string]interface{}{}
+	if targetObject, ok := target.(map[string]interface{}); ok {
+		for name, value := range targetObject {
+			result[name] = value
+		}
+	}
+
+	for name, value := range patchObject {
+		if value == nil {
+			delete(result, name)
+			continue
+		}
+		result[name] = MergePatch(result[name], value)
+	}
+
+	return result
+}
+
+// DecodePatch parses an RFC 6902 patch document and checks that each
+// operation has the members it needs.
+func DecodePatch(rawPatch json.RawMessage) ([]Operation, error) {
+	var rawOperations []map[string]json.RawMessage
+	if err := json.Unmarshal(rawPatch, &rawOperations); err != nil {
+		return nil, fmt.Errorf("a JSON patch must be an array of operations: %s", err)
+	}
+
+	operations := []Operation{}
+	for i, rawOperation := range rawOperations {
+		var operation Operation
+		if err := decodeMember(rawOperation, "op", &operation.Op); err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+		if err := decodeMember(rawOperation, "path", &operation.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+
+		var err error
+		switch operation.Op {
+		case "add", "replace", "test":
+			rawValue, ok := rawOperation["value"]
+			if !ok {
+				err = fmt.Errorf("%q requires a value", operation.Op)
+				break
+			}
+			err = json.Unmarshal(rawValue, &operation.Value)
+		case "move", "copy":
+			err = decodeMember(rawOperation, "from", &operation.From)
+			if err == nil {
+				_, err = parsePointer(operation.From)
+			}
+		case "remove":
+		default:
+			err = fmt.Errorf("unknown op %q", operation.Op)
+		}
+		if err == nil {
+			_, err = parsePointer(operation.Path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+
+		operations = append(operations, operation)
+	}
+
+	return operations, nil
+}
+
+func decodeMember(rawOperation map[string]json.RawMessage, name string, value *string) error {
+	rawValue, ok := rawOperation[name]
+	if !ok {
+		return fmt.Errorf("missing %q", name)
+	}
+	if err := json.Unmarshal(rawValue, value); err != nil {
+		return fmt.Errorf("%q must be a string", name)
+	}
+	return nil
+}
+
+// ApplyPatch applies an RFC 6902 patch. Operations are applied in order and
+// the document is left unchanged if any of them fails.
+func ApplyPatch(document interface{}, operations []Operation) (interface{}, error) {
+	document, err := deepCopy(document)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, operation := range operations {
+		document, err = apply(document, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %s", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return document, nil
+}
+
+func apply(document interface{}, operation Operation) (interface{}, error) {
+	path, err := parsePointer(operation.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch operation.Op {
+	case "add":
+		return add(document, path, operation.Value)
+	case "remove":
+		return remove(document, path)
+	case "replace":
+		if _, err := get(document, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return operation.Value, nil
+		}
+		return update(document, path, func(container interface{}, token string) (interface{}, error) {
+			switch container := container.(type) {
+			case map[string]interface{}:
+				container[token] = operation.Value
+			case []interface{}:
+				index, _ := arrayIndex(token, len(container))
+				container[index] = operation.Value
+			}
+			return container, nil
+		})
+	case "test":
+		value, err := get(document, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, operation.Value) {
+			return nil, fmt.Errorf("test failed, the value is different")
+		}
+		return document, nil
+	case "move", "copy":
+		from, err := parsePointer(operation.From)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := get(document, from)
+		if err != nil {
+			return nil, err
+		}
+
+		if operation.Op == "move" {
+			if operation.Path != operation.From && strings.HasPrefix(operation.Path, operation.From+"/") {
+				return nil, fmt.Errorf("cannot move a value into one of its children")
+			}
+			if document, err = remove(document, from); err != nil {
+				return nil, err
+			}
+		} else if value, err = deepCopy(value); err != nil {
+			return nil, err
+		}
+
+		return add(document, path, value)
+	}
+
+	return nil, fmt.Errorf("unknown op %q", operation.Op)
+}
+
+func add(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(document, path, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index := len(container)
+			if token != "-" {
+				var err error
+				if index, err = arrayIndex(token, len(container)+1); err != nil {
+					return nil, err
+				}
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("cannot add to a %T", container)
+	})
+}
+
+func remove(document interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+
+	return update(document, path, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove from a %T", container)
+	})
+}
+
+// update replaces the container holding the last token of path with the
+// result of change, rebuilding each parent on the way back up.
+func update(node interface{}, path []string, change func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(node, path[0])
+	}
+
+	child, err := child(node, path[0])
+	if err != nil {
+		return nil, err
+	}
+
+	child, err = update(child, path[1:], change)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node := node.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(path[0], len(node))
+		node[index] = child
+	}
+	return node, nil
+}
+
+func get(document interface{}, path []string) (interface{}, error) {
+	node := document
+	for _, token := range path {
+		var err error
+		if node, err = child(node, token); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func child(node interface{}, token string) (interface{}, error) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		value, ok := node[token]
+		if !ok {
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+		return value, nil
+	case []interface{}:
+		index, err := arrayIndex(token, len(node))
+		if err != nil {
+			return nil, err
+		}
+		return node[index], nil
+	}
+	return nil, fmt.Errorf("%q does not exist", token)
+}
+
+// arrayIndex parses an array index that must be below limit.
+func arrayIndex(token string, limit int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || strconv.Itoa(index) != token {
+		return 0, fmt.Errorf("%q is not an array index", token)
+	}
+	if index >= limit {
+		return 0, fmt.Errorf("index %d is out of range", index)
+	}
+	return index, nil
+}
+
+// parsePointer splits an RFC 6901 JSON pointer into unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q is not a JSON pointer", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func deepCopy(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied interface{}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
@@ -0,0 +1,154 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, document string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %s", document, err)
+	}
+	return value
+}
+
+// The examples of RFC 7396 appendix A.
+func TestMergePatch(t *testing.T) {
+	for _, test := range []struct {
+		target, patch, result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		target := decode(t, test.target)
+		result := MergePatch(target, decode(t, test.patch))
+		if !reflect.DeepEqual(result, decode(t, test.result)) {
+			t.Errorf("merging %s into %s: expected %s, got %v", test.patch, test.target, test.result, result)
+		}
+		if !reflect.DeepEqual(target, decode(t, test.target)) {
+			t.Errorf("merging %s into %s changed the target to %v", test.patch, test.target, target)
+		}
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		document, patch   string
+		result, errorPart string
+	}{
+		// the examples of RFC 6902 appendix A
+		{"A.1 add an object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, ""},
+		{"A.2 add an array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, ""},
+		{"A.3 remove an object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, ""},
+		{"A.4 remove an array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, ""},
+		{"A.5 replace a value", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, ""},
+		{"A.6 move a value", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, ""},
+		{"A.7 move an array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, ""},
+		{"A.8 test a value", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, ""},
+		{"A.9 test a value fails", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, "", "test failed"},
+		{"A.10 add a nested member object", `{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`, ""},
+		{"A.11 ignore unrecognized elements", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux","xyz":123}]`, `{"foo":"bar","baz":"qux"}`, ""},
+		{"A.12 add to a nonexistent target", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, "", `"baz" does not exist`},
+		{"A.14 ~ escape ordering", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, ""},
+		{"A.15 compare strings and numbers", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":"10"}]`, "", "test failed"},
+		{"A.16 add an array value", `{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, ""},
+
+		{"~1 escapes a slash", `{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`, ""},
+		{"~0 escapes a tilde", `{"m~n":1}`, `[{"op":"remove","path":"/m~0n"}]`, `{}`, ""},
+		{"add at the end of an array", `{"a":[1]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2]}`, ""},
+		{"add replaces the whole document", `{"a":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, ""},
+		{"copy a value", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, ""},
+		{"operations apply in order", `{}`, `[{"op":"add","path":"/a","value":1},{"op":"move","from":"/a","path":"/b"}]`, `{"b":1}`, ""},
+
+		{"remove a missing member", `{"a":1}`, `[{"op":"remove","path":"/b"}]`, "", `"b" does not exist`},
+		{"remove beyond an array", `{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, "", "index 1 is out of range"},
+		{"remove the last element with -", `{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`, "", `"-" is not an array index`},
+		{"remove the whole document", `{"a":1}`, `[{"op":"remove","path":""}]`, "", "cannot remove the whole document"},
+		{"replace a missing member", `{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, "", `"b" does not exist`},
+		{"move from a missing member", `{"a":1}`, `[{"op":"move","from":"/b","path":"/c"}]`, "", `"b" does not exist`},
+		{"move into a child", `{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`, "", "cannot move a value into one of its children"},
+		{"test a missing member", `{"a":1}`, `[{"op":"test","path":"/b","value":1}]`, "", `"b" does not exist`},
+		{"leading zeros are not indexes", `{"a":[1,2]}`, `[{"op":"test","path":"/a/01","value":2}]`, "", `"01" is not an array index`},
+		{"add beyond an array", `{"a":[1]}`, `[{"op":"add","path":"/a/2","value":2}]`, "", "index 2 is out of range"},
+		{"add into a string", `{"a":"b"}`, `[{"op":"add","path":"/a/b","value":1}]`, "", "cannot add to a string"},
+		{"a failure names the operation", `{"a":1}`, `[{"op":"test","path":"/a","value":1},{"op":"remove","path":"/b"}]`, "", "operation 1 (remove /b)"},
+	} {
+		operations, err := DecodePatch(json.RawMessage(test.patch))
+		if err != nil {
+			t.Errorf("%s: unexpected decode error %s", test.name, err)
+			continue
+		}
+
+		document := decode(t, test.document)
+		result, err := ApplyPatch(document, operations)
+		if test.errorPart != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorPart) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.errorPart, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		} else if !reflect.DeepEqual(result, decode(t, test.result)) {
+			t.Errorf("%s: expected %s, got %v", test.name, test.result, result)
+		}
+
+		if !reflect.DeepEqual(document, decode(t, test.document)) {
+			t.Errorf("%s: the document was changed to %v", test.name, document)
+		}
+	}
+}
+
+func TestDecodePatchErrors(t *testing.T) {
+	for _, test := range []struct {
+		patch, errorPart string
+	}{
+		{`{"op":"add","path":"/a","value":1}`, "must be an array of operations"},
+		{`[{"path":"/a","value":1}]`, `operation 0: missing "op"`},
+		{`[{"op":"add","value":1}]`, `operation 0: missing "path"`},
+		{`[{"op":1,"path":"/a"}]`, `"op" must be a string`},
+		{`[{"op":"merge","path":"/a"}]`, `unknown op "merge"`},
+		{`[{"op":"add","path":"/a"}]`, `"add" requires a value`},
+		{`[{"op":"replace","path":"/a"}]`, `"replace" requires a value`},
+		{`[{"op":"test","path":"/a"}]`, `"test" requires a value`},
+		{`[{"op":"move","path":"/a"}]`, `missing "from"`},
+		{`[{"op":"copy","from":"a","path":"/b"}]`, `"a" is not a JSON pointer`},
+		{`[{"op":"remove","path":"/a"},{"op":"remove","path":"a"}]`, `operation 1: "a" is not a JSON pointer`},
+	} {
+		_, err := DecodePatch(json.RawMessage(test.patch))
+		if err == nil || !strings.Contains(err.Error(), test.errorPart) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.patch, test.errorPart, err)
+		}
+	}
+}
+
+func TestApplyPatchAcceptsANullValue(t *testing.T) {
+	operations, err := DecodePatch(json.RawMessage(`[{"op":"add","path":"/a","value":null}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ApplyPatch(map[string]interface{}{}, operations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := result.(map[string]interface{})["a"]; !ok || value != nil {
+		t.Errorf("expected a to be null, got %v", result)
+	}
+}
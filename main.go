@@ -1,14 +1,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
 	"code.cloudfoundry.org/lager"
+	"github.com/ablease/credhub-broker/admin"
+	"github.com/ablease/credhub-broker/audit"
+	"github.com/ablease/credhub-broker/basicauth"
 	"github.com/ablease/credhub-broker/broker"
+	"github.com/ablease/credhub-broker/health"
+	"github.com/ablease/credhub-broker/metrics"
+	"github.com/ablease/credhub-broker/servertls"
+	"github.com/ablease/credhub-broker/store"
 	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
 	"github.com/cloudfoundry-incubator/credhub-cli/credhub/auth"
 	"github.com/cloudfoundry-incubator/credhub-cli/util"
+	"github.com/gorilla/mux"
 	"github.com/pivotal-cf/brokerapi"
 )
 
@@ -18,39 +32,397 @@ func main() {
 	brokerLogger.RegisterSink(lager.NewWriterSink(os.Stderr, lager.ERROR))
 	brokerLogger.Info("starting up the secure credentials broker...")
 
-	credHubClient := authenticate()
-	serviceBroker := &broker.CredhubServiceBroker{CredHubClient: credHubClient, Logger: brokerLogger}
+	registry := metrics.NewRegistry()
+	backingStore, readinessChecks := credentialStore(brokerLogger)
+	credStore := store.NewResilientStore(
+		store.NewInstrumentedStore(backingStore, metrics.NewStoreMetrics(registry)),
+		resilienceConfig(), metrics.NewResilienceMetrics(registry), brokerLogger,
+	)
+	serviceBroker := &broker.CredhubServiceBroker{
+		Store:           credStore,
+		Catalog:         loadCatalog(brokerLogger),
+		KubernetesRules: loadKubernetesRules(brokerLogger),
+		Audit:           auditLogger(brokerLogger),
+		Logger:          brokerLogger,
+	}
+	reconciler := newReconciler(credStore, brokerLogger)
 
-	brokerCredentials := brokerapi.BrokerCredentials{
-		Username: "admin",
-		Password: "admin",
+	brokerCredentials, err := basicauth.LoadCredentials("BROKER")
+	if err != nil {
+		brokerLogger.Fatal("loading-broker-credentials", err)
 	}
+	brokerAuth := basicauth.NewWrapper(brokerCredentials)
 
-	brokerAPI := brokerapi.New(serviceBroker, brokerLogger, brokerCredentials)
+	brokerAPI := mux.NewRouter()
+	brokerapi.AttachRoutes(brokerAPI, metrics.NewBroker(serviceBroker, registry), brokerLogger)
 
-	http.Handle("/", brokerAPI)
+	http.Handle("/", brokerAuth.Wrap(audit.IdentityHandler(broker.ResponseStatusHandler(brokerAPI))))
+	http.Handle("/admin/", brokerAuth.Wrap(admin.New(serviceBroker, reconciler, brokerLogger)))
+	stop := make(chan struct{})
+	serveMetrics(registry, reconciler, stop, brokerLogger)
+	serveHealth(append(readinessChecks, health.CanaryCheck(credStore, "/c/"+broker.BrokerID+"/health")), brokerLogger)
+
+	reconciled := make(chan struct{})
+	go func() {
+		reconciler.Run(stop)
+		close(reconciled)
+	}()
 
 	var port string
 	if port = os.Getenv("PORT"); len(port) == 0 {
 		port = "8080"
 	}
 
-	brokerLogger.Fatal("http-listen", http.ListenAndServe(":"+port, nil))
+	server := &http.Server{Addr: ":" + port}
+	timeout := shutdownTimeout()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	if os.Getenv("TLS_CERT_FILE") == "" {
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				brokerLogger.Fatal("http-listen", err)
+			}
+		}()
+	} else {
+		server.TLSConfig = serverTLS(stop, brokerLogger)
+		brokerLogger.Info("serving over TLS")
+		go func() {
+			if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				brokerLogger.Fatal("https-listen", err)
+			}
+		}()
+	}
+
+	received := <-signals
+	brokerLogger.Info("shutting-down", lager.Data{"signal": received.String(), "timeout": timeout.String()})
+	shutdown(server, serviceBroker, stop, reconciled, timeout, brokerLogger)
+}
+
+// shutdownTimeout is how long the broker waits for in-flight requests and
+// operations after SIGTERM. Cloud Foundry kills the process 10 seconds after
+// sending it, so the default leaves time to checkpoint what is still running.
+func shutdownTimeout() time.Duration {
+	timeout := 8 * time.Second
+	if configured := os.Getenv("SHUTDOWN_TIMEOUT"); configured != "" {
+		var err error
+		timeout, err = time.ParseDuration(configured)
+		if err != nil || timeout <= 0 {
+			panic("SHUTDOWN_TIMEOUT is not a valid duration: " + configured)
+		}
+	}
+
+	return timeout
+}
+
+// shutdown stops accepting requests, waits for in-flight requests and then
+// background operations to finish, and records the operations that did not
+// finish in time as failed so the platform can retry them. Requests get the
+// first half of the timeout and operations the third quarter, which leaves
+// the last quarter for recording the interrupted operations and for a
+// reconcile in progress to finish.
+func shutdown(server *http.Server, serviceBroker *broker.CredhubServiceBroker, stop chan struct{}, reconciled <-chan struct{}, timeout time.Duration, logger lager.Logger) {
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(context.Background(), start.Add(timeout))
+	defer cancel()
+	requestsCtx, cancelRequests := context.WithDeadline(ctx, start.Add(timeout/2))
+	defer cancelRequests()
+	operationsCtx, cancelOperations := context.WithDeadline(ctx, start.Add(timeout*3/4))
+	defer cancelOperations()
+
+	close(stop)
+
+	if err := server.Shutdown(requestsCtx); err != nil {
+		logger.Error("draining-requests-failed", err)
+	}
+	if err := serviceBroker.Shutdown(operationsCtx); err != nil {
+		logger.Error("waiting-for-operations-failed", err)
+	}
+
+	select {
+	case <-reconciled:
+	case <-ctx.Done():
+		logger.Error("waiting-for-reconciler-failed", ctx.Err())
+	}
+
+	logger.Info("shut-down")
+}
+
+// serveMetrics serves /metrics when METRICS credentials are configured. They
+// are separate from the broker's so scrapers cannot call the broker API.
+func serveMetrics(registry *metrics.Registry, reconciler *broker.Reconciler, stop chan struct{}, logger lager.Logger) {
+	metricsCredentials, err := basicauth.LoadCredentials("METRICS")
+	if err == basicauth.ErrNoCredentials {
+		logger.Info("metrics endpoint disabled, no METRICS credentials are configured")
+		return
+	}
+	if err != nil {
+		logger.Fatal("loading-metrics-credentials", err)
+	}
+
+	interval := time.Minute
+	if refreshInterval := os.Getenv("METRICS_REFRESH_INTERVAL"); refreshInterval != "" {
+		interval, err = time.ParseDuration(refreshInterval)
+		if err != nil || interval <= 0 {
+			panic("METRICS_REFRESH_INTERVAL is not a valid duration: " + refreshInterval)
+		}
+	}
+
+	go metrics.NewInventory(registry).Run(reconciler.Count, interval, stop, logger)
+
+	http.Handle("/metrics", basicauth.NewWrapper(metricsCredentials).Wrap(registry))
+}
+
+// serveHealth serves /healthz for liveness and /readyz for readiness without
+// authentication, so platform probes can reach them.
+func serveHealth(checks []health.Check, logger lager.Logger) {
+	ttl := 10 * time.Second
+	if cacheTTL := os.Getenv("HEALTH_CACHE_TTL"); cacheTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cacheTTL)
+		if err != nil || ttl < 0 {
+			panic("HEALTH_CACHE_TTL is not a valid duration: " + cacheTTL)
+		}
+	}
+
+	checker := health.NewChecker(ttl, logger, checks...)
+	if checkTimeout := os.Getenv("HEALTH_CHECK_TIMEOUT"); checkTimeout != "" {
+		timeout, err := time.ParseDuration(checkTimeout)
+		if err != nil || timeout <= 0 {
+			panic("HEALTH_CHECK_TIMEOUT is not a valid duration: " + checkTimeout)
+		}
+		checker.Timeout = timeout
+	}
+
+	http.Handle("/healthz", health.Liveness())
+	http.Handle("/readyz", checker)
+}
+
+func serverTLS(stop chan struct{}, logger lager.Logger) *tls.Config {
+	reloader, err := servertls.NewCertificateReloader(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), logger)
+	if err != nil {
+		panic("TLS configured incorrectly: " + err.Error())
+	}
+
+	tlsConfig, err := servertls.NewConfig(servertls.Config{
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+		MinVersion:   os.Getenv("TLS_MIN_VERSION"),
+	}, reloader)
+	if err != nil {
+		panic("TLS configured incorrectly: " + err.Error())
+	}
+
+	interval := time.Minute
+	if reloadInterval := os.Getenv("TLS_RELOAD_INTERVAL"); reloadInterval != "" {
+		interval, err = time.ParseDuration(reloadInterval)
+		if err != nil || interval <= 0 {
+			panic("TLS_RELOAD_INTERVAL is not a valid duration: " + reloadInterval)
+		}
+	}
+
+	go reloader.Run(interval, stop)
+
+	return tlsConfig
+}
+
+func loadCatalog(logger lager.Logger) *broker.Catalog {
+	path := os.Getenv("CATALOG_PATH")
+	if path == "" {
+		return broker.DefaultCatalog()
+	}
+
+	catalog, err := broker.LoadCatalog(path)
+	if err != nil {
+		panic("catalog configured incorrectly: " + err.Error())
+	}
+
+	logger.Info("loaded catalog", lager.Data{"path": path})
+	return catalog
+}
+
+func loadKubernetesRules(logger lager.Logger) []broker.KubernetesRule {
+	path := os.Getenv("KUBERNETES_RULES_PATH")
+	if path == "" {
+		return nil
+	}
+
+	rules, err := broker.LoadKubernetesRules(path)
+	if err != nil {
+		panic("kubernetes rules configured incorrectly: " + err.Error())
+	}
+
+	logger.Info("loaded kubernetes rules", lager.Data{"path": path, "rules": len(rules)})
+	return rules
+}
+
+// auditLogger sends audit events to the sink named by AUDIT_SINK. They are
+// not recorded when it is unset.
+func auditLogger(logger lager.Logger) *audit.Logger {
+	var sink audit.Sink
+	var err error
+
+	switch os.Getenv("AUDIT_SINK") {
+	case "":
+		return nil
+	case "stdout":
+		sink = audit.NewWriterSink(os.Stdout)
+	case "file":
+		var fileSink *audit.FileSink
+		fileSink, err = audit.NewFileSink(os.Getenv("AUDIT_FILE"))
+		if err == nil {
+			reopenOnHangup(fileSink, logger)
+		}
+		sink = fileSink
+	case "syslog":
+		sink, err = audit.NewSyslogSink(os.Getenv("AUDIT_SYSLOG_NETWORK"), os.Getenv("AUDIT_SYSLOG_ADDRESS"), "secure-credentials-broker")
+	default:
+		panic("AUDIT_SINK must be stdout, file or syslog: " + os.Getenv("AUDIT_SINK"))
+	}
+	if err != nil {
+		panic("audit sink configured incorrectly: " + err.Error())
+	}
+
+	logger.Info("recording audit events", lager.Data{"sink": os.Getenv("AUDIT_SINK")})
+	return audit.NewLogger(logger, sink)
+}
+
+// reopenOnHangup reopens the audit file on SIGHUP, which log rotation sends
+// after moving the file aside.
+func reopenOnHangup(fileSink *audit.FileSink, logger lager.Logger) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			if err := fileSink.Reopen(); err != nil {
+				logger.Error("reopening-audit-file-failed", err)
+				continue
+			}
+			logger.Info("reopened audit file")
+		}
+	}()
+}
+
+func newReconciler(credStore store.Store, logger lager.Logger) *broker.Reconciler {
+	reconciler := &broker.Reconciler{
+		Store:         credStore,
+		Logger:        logger,
+		DeleteOrphans: os.Getenv("RECONCILE_DELETE_ORPHANS") == "true",
+		GracePeriod:   durationSetting("RECONCILE_GRACE_PERIOD", broker.DefaultReconcileGracePeriod),
+	}
+
+	if client := os.Getenv("CREDHUB_CLIENT"); client != "" {
+		reconciler.IgnoredActors = append(reconciler.IgnoredActors, "uaa-client:"+client)
+	}
+
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		duration, err := time.ParseDuration(interval)
+		if err != nil {
+			panic("RECONCILE_INTERVAL is not a valid duration: " + err.Error())
+		}
+		reconciler.Interval = duration
+	}
+
+	return reconciler
+}
+
+// credentialStore returns the store credentials are kept in and the checks
+// that tell whether it is ready.
+func credentialStore(logger lager.Logger) (store.Store, []health.Check) {
+	if os.Getenv("CREDENTIAL_STORE") == "memory" {
+		logger.Info("using in-memory credential store, credentials will not survive a restart")
+		return store.NewMemoryStore(), nil
+	}
+
+	credHubClient := authenticate()
+	return store.NewCredHubStore(credHubClient), health.CredHubChecks(credHubClient)
+}
+
+// resilienceConfig reads how calls to CredHub are timed out, retried and cut
+// off while CredHub is unavailable. A CREDHUB_BREAKER_THRESHOLD of 0 turns the
+// circuit breaker off and a CREDHUB_TIMEOUT of 0 turns timeouts off.
+func resilienceConfig() store.ResilienceConfig {
+	config := store.DefaultResilienceConfig()
+	config.Attempts = intSetting("CREDHUB_RETRY_ATTEMPTS", config.Attempts, 1)
+	config.BaseDelay = durationSetting("CREDHUB_RETRY_BASE_DELAY", config.BaseDelay)
+	config.MaxDelay = durationSetting("CREDHUB_RETRY_MAX_DELAY", config.MaxDelay)
+	config.Timeout = durationSetting("CREDHUB_TIMEOUT", config.Timeout)
+	config.FailureThreshold = intSetting("CREDHUB_BREAKER_THRESHOLD", config.FailureThreshold, 0)
+	config.Cooldown = durationSetting("CREDHUB_BREAKER_COOLDOWN", config.Cooldown)
+	return config
+}
+
+func intSetting(variable string, value, minimum int) int {
+	setting := os.Getenv(variable)
+	if setting == "" {
+		return value
+	}
+
+	value, err := strconv.Atoi(setting)
+	if err != nil || value < minimum {
+		panic(variable + " must be a number of at least " + strconv.Itoa(minimum) + ": " + setting)
+	}
+	return value
+}
+
+func durationSetting(variable string, value time.Duration) time.Duration {
+	setting := os.Getenv(variable)
+	if setting == "" {
+		return value
+	}
+
+	value, err := time.ParseDuration(setting)
+	if err != nil || value < 0 {
+		panic(variable + " is not a valid duration: " + setting)
+	}
+	return value
 }
 
 func authenticate() *credhub.CredHub {
+	options := []credhub.Option{}
 
-	skipTLSValidation := false
-	if skipTLS := os.Getenv("SKIP_TLS_VALIDATION"); skipTLS == "true" {
-		skipTLSValidation = true
+	if os.Getenv("SKIP_TLS_VALIDATION") == "true" {
+		if os.Getenv("FORCE_INSECURE") != "true" {
+			panic("credhub client configured incorrectly: SKIP_TLS_VALIDATION requires FORCE_INSECURE=true, configure CREDHUB_CA_CERT instead")
+		}
+		options = append(options, credhub.SkipTLSValidation(true))
 	}
 
-	ch, err := credhub.New(
-		util.AddDefaultSchemeIfNecessary(os.Getenv("CREDHUB_SERVER")),
-		credhub.SkipTLSValidation(skipTLSValidation),
-		credhub.Auth(auth.UaaClientCredentials(os.Getenv("CREDHUB_CLIENT"), os.Getenv("CREDHUB_SECRET"))),
-	)
+	caCerts := []string{}
+	for _, variable := range []string{"CREDHUB_CA_CERT", "UAA_CA_CERT"} {
+		if field := os.Getenv(variable); field != "" {
+			caCert, err := util.ReadFileOrStringFromField(field)
+			if err != nil {
+				panic("credhub client configured incorrectly: " + variable + ": " + err.Error())
+			}
+			caCerts = append(caCerts, caCert)
+		}
+	}
+	if len(caCerts) > 0 {
+		options = append(options, credhub.CaCerts(caCerts...))
+	}
+
+	clientCert, clientKey := os.Getenv("CREDHUB_CLIENT_CERT"), os.Getenv("CREDHUB_CLIENT_KEY")
+	if clientCert != "" || clientKey != "" {
+		options = append(options, credhub.ClientCert(clientCert, clientKey))
+	}
+
+	// a client certificate alone is enough for CredHub, UAA credentials are
+	// used whenever they are configured
+	switch {
+	case os.Getenv("CREDHUB_CLIENT") != "":
+		if authURL := os.Getenv("UAA_URL"); authURL != "" {
+			options = append(options, credhub.AuthURL(authURL))
+		}
+		options = append(options, credhub.Auth(auth.UaaClientCredentials(os.Getenv("CREDHUB_CLIENT"), os.Getenv("CREDHUB_SECRET"))))
+	case clientCert != "":
+		options = append(options, credhub.Auth(auth.Noop))
+	default:
+		panic("credhub client configured incorrectly: set CREDHUB_CLIENT and CREDHUB_SECRET, or CREDHUB_CLIENT_CERT and CREDHUB_CLIENT_KEY")
+	}
 
+	ch, err := credhub.New(util.AddDefaultSchemeIfNecessary(os.Getenv("CREDHUB_SERVER")), options...)
 	if err != nil {
 		panic("credhub client configured incorrectly: " + err.Error())
 	}
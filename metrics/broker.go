@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	OutcomeSuccess     = "success"
+	OutcomeAsync       = "async"
+	OutcomeClientError = "client_error"
+	OutcomeError       = "error"
+
+	// UnknownPlan labels requests for plans that are not in the catalog.
+	UnknownPlan = "unknown"
+)
+
+// Broker counts and times the service broker API operations of the broker
+// it wraps, labelled by outcome and plan.
+type Broker struct {
+	Broker brokerapi.ServiceBroker
+
+	plans     map[string]bool
+	requests  *Counter
+	durations *Histogram
+}
+
+func NewBroker(serviceBroker brokerapi.ServiceBroker, registry *Registry) *Broker {
+	plans := map[string]bool{}
+	for _, service := range serviceBroker.Services(context.Background()) {
+		for _, plan := range service.Plans {
+			plans[plan.ID] = true
+		}
+	}
+
+	return &Broker{
+		Broker: serviceBroker,
+		plans:  plans,
+		requests: registry.NewCounter("credhub_broker_osb_requests_total",
+			"Service broker API requests by operation, outcome and plan.",
+			"operation", "outcome", "plan"),
+		durations: registry.NewHistogram("credhub_broker_osb_request_duration_seconds",
+			"Time taken to handle service broker API requests.",
+			DefaultBuckets, "operation", "outcome", "plan"),
+	}
+}
+
+func (metricsBroker *Broker) Services(ctx context.Context) []brokerapi.Service {
+	start := time.Now()
+	services := metricsBroker.Broker.Services(ctx)
+	metricsBroker.observe("catalog", "", start, false, nil)
+	return services
+}
+
+func (metricsBroker *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	start := time.Now()
+	spec, err := metricsBroker.Broker.Provision(ctx, instanceID, details, asyncAllowed)
+	metricsBroker.observe("provision", details.PlanID, start, spec.IsAsync, err)
+	return spec, err
+}
+
+func (metricsBroker *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
+	start := time.Now()
+	spec, err := metricsBroker.Broker.Deprovision(ctx, instanceID, details, asyncAllowed)
+	metricsBroker.observe("deprovision", details.PlanID, start, spec.IsAsync, err)
+	return spec, err
+}
+
+func (metricsBroker *Broker) Bind(ctx context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
+	start := time.Now()
+	binding, err := metricsBroker.Broker.Bind(ctx, instanceID, bindingID, details)
+	metricsBroker.observe("bind", details.PlanID, start, false, err)
+	return binding, err
+}
+
+func (metricsBroker *Broker) Unbind(ctx context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
+	start := time.Now()
+	err := metricsBroker.Broker.Unbind(ctx, instanceID, bindingID, details)
+	metricsBroker.observe("unbind", details.PlanID, start, false, err)
+	return err
+}
+
+func (metricsBroker *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
+	start := time.Now()
+	spec, err := metricsBroker.Broker.Update(ctx, instanceID, details, asyncAllowed)
+	metricsBroker.observe("update", details.PlanID, start, spec.IsAsync, err)
+	return spec, err
+}
+
+func (metricsBroker *Broker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	start := time.Now()
+	operation, err := metricsBroker.Broker.LastOperation(ctx, instanceID, operationData)
+	metricsBroker.observe("last_operation", "", start, false, err)
+	return operation, err
+}
+
+// observe records a request. Plan IDs come straight from the request, so
+// IDs that are not in the catalog share one label rather than adding a
+// series each.
+func (metricsBroker *Broker) observe(operation, plan string, start time.Time, async bool, err error) {
+	if plan != "" && !metricsBroker.plans[plan] {
+		plan = UnknownPlan
+	}
+
+	outcome := outcome(async, err)
+	metricsBroker.requests.Inc(operation, outcome, plan)
+	metricsBroker.durations.Observe(time.Since(start).Seconds(), operation, outcome, plan)
+}
+
+func outcome(async bool, err error) string {
+	if err == nil {
+		if async {
+			return OutcomeAsync
+		}
+		return OutcomeSuccess
+	}
+
+	if failure, ok := err.(*brokerapi.FailureResponse); ok && failure.ValidatedStatusCode(nil) < 500 {
+		return OutcomeClientError
+	}
+	return OutcomeError
+}
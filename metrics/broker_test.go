@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// catalogBroker offers a single plan and rejects every provision.
+type catalogBroker struct {
+	brokerapi.ServiceBroker
+}
+
+func (catalogBroker) Services(ctx context.Context) []brokerapi.Service {
+	return []brokerapi.Service{{ID: "service-id", Plans: []brokerapi.ServicePlan{{ID: "plan-id", Name: "default"}}}}
+}
+
+func (catalogBroker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	if details.PlanID != "plan-id" {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(errors.New("plan does not exist"), http.StatusBadRequest, "plan-not-found")
+	}
+	return brokerapi.ProvisionedServiceSpec{}, nil
+}
+
+func (catalogBroker) LastOperation(ctx context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
+	return brokerapi.LastOperation{}, errors.New("no operation")
+}
+
+func TestBrokerLabelsRequests(t *testing.T) {
+	registry := NewRegistry()
+	metricsBroker := NewBroker(catalogBroker{}, registry)
+
+	for _, planID := range []string{"plan-id", "made-up-1", "made-up-2"} {
+		metricsBroker.Provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{PlanID: planID}, false)
+	}
+	metricsBroker.LastOperation(context.Background(), "instance-id", "")
+
+	output := &bytes.Buffer{}
+	registry.WriteTo(output)
+
+	for _, line := range []string{
+		`credhub_broker_osb_requests_total{operation="provision",outcome="success",plan="plan-id"} 1`,
+		`credhub_broker_osb_requests_total{operation="provision",outcome="client_error",plan="unknown"} 2`,
+		`credhub_broker_osb_requests_total{operation="last_operation",outcome="error",plan=""} 1`,
+	} {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("expected %s in:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output.String(), "made-up") {
+		t.Errorf("expected plan IDs outside the catalog not to be labelled:\n%s", output)
+	}
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// Inventory reports how many service instances and bindings the broker
+// manages.
+type Inventory struct {
+	instances *Gauge
+	bindings  *Gauge
+}
+
+func NewInventory(registry *Registry) *Inventory {
+	return &Inventory{
+		instances: registry.NewGauge("credhub_broker_service_instances", "Service instances managed by the broker."),
+		bindings:  registry.NewGauge("credhub_broker_service_bindings", "Service bindings managed by the broker."),
+	}
+}
+
+func (inventory *Inventory) Set(instances, bindings int) {
+	inventory.instances.Set(float64(instances))
+	inventory.bindings.Set(float64(bindings))
+}
+
+// Run counts instances and bindings straight away and then every interval
+// until stop is closed. Counting reads every path in CredHub, so it is not
+// done on each scrape.
+func (inventory *Inventory) Run(count func() (int, int, error), interval time.Duration, stop <-chan struct{}, logger lager.Logger) {
+	update := func() {
+		instances, bindings, err := count()
+		if err != nil {
+			logger.Error("counting-inventory-failed", err)
+			return
+		}
+		inventory.Set(instances, bindings)
+	}
+
+	update()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			update()
+		case <-stop:
+			return
+		}
+	}
+}
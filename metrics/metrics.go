@@ -0,0 +1,209 @@
+// Package metrics keeps counters, gauges and histograms in memory and serves
+// them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of latency histograms.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: map[string]bool{}}
+}
+
+type Counter struct{ metric *metric }
+type Gauge struct{ metric *metric }
+type Histogram struct{ metric *metric }
+
+func (registry *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{metric: registry.register(name, help, "counter", nil, labels)}
+}
+
+func (registry *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{metric: registry.register(name, help, "gauge", nil, labels)}
+}
+
+func (registry *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &Histogram{metric: registry.register(name, help, "histogram", buckets, labels)}
+}
+
+func (registry *Registry) register(name, help, kind string, buckets []float64, labels []string) *metric {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if registry.names[name] {
+		panic("metric registered twice: " + name)
+	}
+	registry.names[name] = true
+
+	m := &metric{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+	registry.metrics = append(registry.metrics, m)
+	return m
+}
+
+// Inc adds one to the counter with the given label values.
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	counter.metric.update(labelValues, func(s *series) { s.value += value })
+}
+
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	gauge.metric.update(labelValues, func(s *series) { s.value = value })
+}
+
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	histogram.metric.update(labelValues, func(s *series) {
+		for i, bound := range histogram.metric.buckets {
+			if value <= bound {
+				s.counts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// ServeHTTP writes every metric in the text exposition format.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteTo(w)
+}
+
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.mutex.Lock()
+	metrics := append([]*metric{}, registry.metrics...)
+	registry.mutex.Unlock()
+
+	buffer := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buffer)
+	}
+
+	return buffer.WriteTo(w)
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	count       uint64
+	counts      []uint64
+}
+
+func (m *metric) update(labelValues []string, change func(*series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	change(s)
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := []string{}
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/ablease/credhub-broker/store"
+)
+
+// StoreMetrics times the broker's calls to CredHub and counts their errors by
+// kind. It is the Observer of a store.InstrumentedStore.
+type StoreMetrics struct {
+	durations *Histogram
+	errors    *Counter
+}
+
+func NewStoreMetrics(registry *Registry) *StoreMetrics {
+	return &StoreMetrics{
+		durations: registry.NewHistogram("credhub_broker_credhub_request_duration_seconds",
+			"Time taken by calls to CredHub by method.",
+			DefaultBuckets, "method"),
+		errors: registry.NewCounter("credhub_broker_credhub_errors_total",
+			"Calls to CredHub that returned an error, by method and kind of error.",
+			"method", "error"),
+	}
+}
+
+func (storeMetrics *StoreMetrics) ObserveCall(method string, duration time.Duration, err error) {
+	storeMetrics.durations.Observe(duration.Seconds(), method)
+	if err != nil {
+		storeMetrics.errors.Inc(method, errorKind(err))
+	}
+}
+
+func errorKind(err error) string {
+	switch err {
+	case store.ErrNotFound:
+		return "not_found"
+	case store.ErrTypeModified:
+		return "type_modified"
+	case store.ErrNotGenerated:
+		return "not_generated"
+	}
+	return "other"
+}
+
+// ResilienceMetrics counts retried and rejected calls to CredHub and shows
+// whether the circuit breaker is open. It is the ResilienceObserver of a
+// store.ResilientStore.
+type ResilienceMetrics struct {
+	retries  *Counter
+	rejected *Counter
+	open     *Gauge
+}
+
+func NewResilienceMetrics(registry *Registry) *ResilienceMetrics {
+	resilienceMetrics := &ResilienceMetrics{
+		retries: registry.NewCounter("credhub_broker_credhub_retries_total",
+			"Calls to CredHub retried after a transient failure, by method and reason.",
+			"method", "reason"),
+		rejected: registry.NewCounter("credhub_broker_credhub_rejected_total",
+			"Calls to CredHub rejected while the circuit breaker was open, by method.",
+			"method"),
+		open: registry.NewGauge("credhub_broker_credhub_circuit_open",
+			"Whether the circuit breaker around CredHub is open."),
+	}
+	resilienceMetrics.open.Set(0)
+	return resilienceMetrics
+}
+
+func (resilienceMetrics *ResilienceMetrics) ObserveRetry(method string, err error) {
+	reason := "error"
+	if err == store.ErrTimeout {
+		reason = "timeout"
+	}
+	resilienceMetrics.retries.Inc(method, reason)
+}
+
+func (resilienceMetrics *ResilienceMetrics) ObserveRejected(method string) {
+	resilienceMetrics.rejected.Inc(method)
+}
+
+func (resilienceMetrics *ResilienceMetrics) ObserveCircuit(open bool) {
+	value := 0.0
+	if open {
+		value = 1
+	}
+	resilienceMetrics.open.Set(value)
+}
@@ -0,0 +1,518 @@
+// Package schema validates JSON documents against the subset of JSON Schema
+// used to describe service broker parameters.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// annotations are keywords that do not affect validation.
+var annotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"id":          true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+	"readOnly":    true,
+	"writeOnly":   true,
+}
+
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (violation Violation) String() string {
+	return violation.Path + ": " + violation.Message
+}
+
+// Schema is a compiled JSON Schema. Keywords outside the supported subset
+// are rejected by Compile rather than silently ignored.
+type Schema struct {
+	boolean *bool
+
+	types                []string
+	enum                 []interface{}
+	constant             interface{}
+	hasConstant          bool
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        *int
+	maxProperties        *int
+	items                *Schema
+	minItems             *int
+	maxItems             *int
+	uniqueItems          bool
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	allOf                []*Schema
+	anyOf                []*Schema
+	oneOf                []*Schema
+	not                  *Schema
+}
+
+// Compile parses a schema decoded from JSON.
+func Compile(raw interface{}) (*Schema, error) {
+	return compile(raw, "#")
+}
+
+func compile(raw interface{}, location string) (*Schema, error) {
+	if boolean, ok := raw.(bool); ok {
+		return &Schema{boolean: &boolean}, nil
+	}
+
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: a schema must be an object or a boolean", location)
+	}
+
+	schema := &Schema{}
+	keywords := []string{}
+	for keyword := range object {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+
+	for _, keyword := range keywords {
+		value := object[keyword]
+		at := location + "/" + keyword
+
+		var err error
+		switch keyword {
+		case "type":
+			schema.types, err = compileTypes(value, at)
+		case "enum":
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				err = fmt.Errorf("%s: must be a non-empty array", at)
+			}
+			schema.enum = list
+		case "const":
+			schema.constant = value
+			schema.hasConstant = true
+		case "properties":
+			schema.properties, err = compileMap(value, at)
+		case "required":
+			schema.required, err = compileStrings(value, at)
+		case "additionalProperties":
+			schema.additionalProperties, err = compile(value, at)
+		case "minProperties":
+			schema.minProperties, err = compileCount(value, at)
+		case "maxProperties":
+			schema.maxProperties, err = compileCount(value, at)
+		case "items":
+			schema.items, err = compile(value, at)
+		case "minItems":
+			schema.minItems, err = compileCount(value, at)
+		case "maxItems":
+			schema.maxItems, err = compileCount(value, at)
+		case "uniqueItems":
+			unique, ok := value.(bool)
+			if !ok {
+				err = fmt.Errorf("%s: must be a boolean", at)
+			}
+			schema.uniqueItems = unique
+		case "minLength":
+			schema.minLength, err = compileCount(value, at)
+		case "maxLength":
+			schema.maxLength, err = compileCount(value, at)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				err = fmt.Errorf("%s: must be a string", at)
+				break
+			}
+			if schema.pattern, err = regexp.Compile(pattern); err != nil {
+				err = fmt.Errorf("%s: %s", at, err)
+			}
+		case "minimum":
+			schema.minimum, err = compileNumber(value, at)
+		case "maximum":
+			schema.maximum, err = compileNumber(value, at)
+		case "exclusiveMinimum", "exclusiveMaximum":
+			err = compileExclusive(schema, keyword, object, at)
+		case "multipleOf":
+			schema.multipleOf, err = compileNumber(value, at)
+			if err == nil && *schema.multipleOf <= 0 {
+				err = fmt.Errorf("%s: must be greater than 0", at)
+			}
+		case "allOf":
+			schema.allOf, err = compileList(value, at)
+		case "anyOf":
+			schema.anyOf, err = compileList(value, at)
+		case "oneOf":
+			schema.oneOf, err = compileList(value, at)
+		case "not":
+			schema.not, err = compile(value, at)
+		default:
+			if !annotations[keyword] {
+				err = fmt.Errorf("%s: unsupported keyword", at)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return schema, nil
+}
+
+// compileExclusive accepts both the draft 4 boolean form, which modifies
+// minimum or maximum, and the later numeric form.
+func compileExclusive(schema *Schema, keyword string, object map[string]interface{}, at string) error {
+	value := object[keyword]
+	bound := "minimum"
+	target := &schema.exclusiveMinimum
+	if keyword == "exclusiveMaximum" {
+		bound = "maximum"
+		target = &schema.exclusiveMaximum
+	}
+
+	if exclusive, ok := value.(bool); ok {
+		if !exclusive {
+			return nil
+		}
+		limit, ok := object[bound].(float64)
+		if !ok {
+			return fmt.Errorf("%s: requires %s", at, bound)
+		}
+		*target = &limit
+		return nil
+	}
+
+	limit, err := compileNumber(value, at)
+	*target = limit
+	return err
+}
+
+func compileTypes(value interface{}, at string) ([]string, error) {
+	var types []string
+	if name, ok := value.(string); ok {
+		types = []string{name}
+	} else {
+		var err error
+		if types, err = compileStrings(value, at); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range types {
+		switch name {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", at, name)
+		}
+	}
+	return types, nil
+}
+
+func compileMap(value interface{}, at string) (map[string]*Schema, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an object", at)
+	}
+
+	schemas := map[string]*Schema{}
+	for name, raw := range object {
+		schema, err := compile(raw, at+"/"+name)
+		if err != nil {
+			return nil, err
+		}
+		schemas[name] = schema
+	}
+	return schemas, nil
+}
+
+func compileList(value interface{}, at string) ([]*Schema, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("%s: must be a non-empty array", at)
+	}
+
+	schemas := []*Schema{}
+	for i, raw := range list {
+		schema, err := compile(raw, at+"/"+strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	return schemas, nil
+}
+
+func compileStrings(value interface{}, at string) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: must be an array of strings", at)
+	}
+
+	names := []string{}
+	for _, item := range list {
+		name, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an array of strings", at)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func compileCount(value interface{}, at string) (*int, error) {
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, fmt.Errorf("%s: must be a non-negative integer", at)
+	}
+	count := int(number)
+	return &count, nil
+}
+
+func compileNumber(value interface{}, at string) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok {
+		return nil, fmt.Errorf("%s: must be a number", at)
+	}
+	return &number, nil
+}
+
+// Validate returns every way in which the document, decoded from JSON,
+// does not match the schema. Paths start at $ for the document root.
+func (schema *Schema) Validate(document interface{}) []Violation {
+	return schema.validate(document, "$")
+}
+
+func (schema *Schema) validate(value interface{}, path string) []Violation {
+	if schema.boolean != nil {
+		if *schema.boolean {
+			return nil
+		}
+		return []Violation{{Path: path, Message: "is not allowed"}}
+	}
+
+	violations := []Violation{}
+	add := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(schema.types) > 0 && !matchesType(value, schema.types) {
+		add("must be of type %s, not %s", strings.Join(schema.types, " or "), typeOf(value))
+		return violations
+	}
+
+	if schema.enum != nil {
+		found := false
+		for _, allowed := range schema.enum {
+			if reflect.DeepEqual(allowed, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", encode(schema.enum))
+		}
+	}
+
+	if schema.hasConstant && !reflect.DeepEqual(schema.constant, value) {
+		add("must be %s", encode(schema.constant))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		violations = append(violations, schema.validateObject(value, path)...)
+	case []interface{}:
+		violations = append(violations, schema.validateArray(value, path)...)
+	case string:
+		length := len([]rune(value))
+		if schema.minLength != nil && length < *schema.minLength {
+			add("must be at least %d characters long", *schema.minLength)
+		}
+		if schema.maxLength != nil && length > *schema.maxLength {
+			add("must be at most %d characters long", *schema.maxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			add("must match the pattern %q", schema.pattern.String())
+		}
+	case float64:
+		if schema.minimum != nil && value < *schema.minimum {
+			add("must be at least %v", *schema.minimum)
+		}
+		if schema.maximum != nil && value > *schema.maximum {
+			add("must be at most %v", *schema.maximum)
+		}
+		if schema.exclusiveMinimum != nil && value <= *schema.exclusiveMinimum {
+			add("must be greater than %v", *schema.exclusiveMinimum)
+		}
+		if schema.exclusiveMaximum != nil && value >= *schema.exclusiveMaximum {
+			add("must be less than %v", *schema.exclusiveMaximum)
+		}
+		if schema.multipleOf != nil {
+			quotient := value / *schema.multipleOf
+			if quotient != math.Trunc(quotient) {
+				add("must be a multiple of %v", *schema.multipleOf)
+			}
+		}
+	}
+
+	for _, subschema := range schema.allOf {
+		violations = append(violations, subschema.validate(value, path)...)
+	}
+
+	if schema.anyOf != nil && countMatches(schema.anyOf, value, path) == 0 {
+		add("must match at least one of the schemas in anyOf")
+	}
+
+	if schema.oneOf != nil {
+		if matches := countMatches(schema.oneOf, value, path); matches != 1 {
+			add("must match exactly one of the schemas in oneOf, matched %d", matches)
+		}
+	}
+
+	if schema.not != nil && len(schema.not.validate(value, path)) == 0 {
+		add("must not match the schema in not")
+	}
+
+	return violations
+}
+
+func (schema *Schema) validateObject(object map[string]interface{}, path string) []Violation {
+	violations := []Violation{}
+
+	for _, name := range schema.required {
+		if _, ok := object[name]; !ok {
+			violations = append(violations, Violation{Path: propertyPath(path, name), Message: "is required"})
+		}
+	}
+
+	if schema.minProperties != nil && len(object) < *schema.minProperties {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("must have at least %d properties", *schema.minProperties)})
+	}
+	if schema.maxProperties != nil && len(object) > *schema.maxProperties {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("must have at most %d properties", *schema.maxProperties)})
+	}
+
+	names := []string{}
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if property, ok := schema.properties[name]; ok {
+			violations = append(violations, property.validate(object[name], propertyPath(path, name))...)
+		} else if schema.additionalProperties != nil {
+			additional := schema.additionalProperties.validate(object[name], propertyPath(path, name))
+			if schema.additionalProperties.boolean != nil && len(additional) > 0 {
+				additional = []Violation{{Path: propertyPath(path, name), Message: "is not an allowed property"}}
+			}
+			violations = append(violations, additional...)
+		}
+	}
+
+	return violations
+}
+
+func (schema *Schema) validateArray(array []interface{}, path string) []Violation {
+	violations := []Violation{}
+
+	if schema.minItems != nil && len(array) < *schema.minItems {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("must have at least %d items", *schema.minItems)})
+	}
+	if schema.maxItems != nil && len(array) > *schema.maxItems {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf("must have at most %d items", *schema.maxItems)})
+	}
+
+	if schema.uniqueItems {
+		for i := range array {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(array[i], array[j]) {
+					violations = append(violations, Violation{Path: fmt.Sprintf("%s[%d]", path, i), Message: fmt.Sprintf("duplicates item %d", j)})
+					break
+				}
+			}
+		}
+	}
+
+	if schema.items != nil {
+		for i, item := range array {
+			violations = append(violations, schema.items.validate(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	return violations
+}
+
+func countMatches(schemas []*Schema, value interface{}, path string) int {
+	matches := 0
+	for _, schema := range schemas {
+		if len(schema.validate(value, path)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+func matchesType(value interface{}, types []string) bool {
+	actual := typeOf(value)
+	for _, name := range types {
+		if name == actual || (name == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func propertyPath(path, name string) string {
+	if identifier.MatchString(name) {
+		return path + "." + name
+	}
+	return path + "[" + strconv.Quote(name) + "]"
+}
+
+func encode(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -0,0 +1,133 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, document string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		t.Fatalf("invalid JSON %s: %s", document, err)
+	}
+	return value
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		schema     string
+		document   string
+		violations []string
+	}{
+		{"type matches", `{"type":"string"}`, `"a"`, nil},
+		{"type mismatch", `{"type":"string"}`, `1`, []string{"$: must be of type string, not integer"}},
+		{"type list", `{"type":["string","null"]}`, `null`, nil},
+		{"integer is a number", `{"type":"number"}`, `1`, nil},
+		{"number is not an integer", `{"type":"integer"}`, `1.5`, []string{"$: must be of type integer, not number"}},
+		{"type mismatch stops validation", `{"type":"object","required":["a"]}`, `[]`, []string{"$: must be of type object, not array"}},
+
+		{"required present", `{"required":["a"]}`, `{"a":1}`, nil},
+		{"required missing", `{"required":["a","b-c"]}`, `{}`, []string{"$.a: is required", `$["b-c"]: is required`}},
+		{"required ignores other types", `{"required":["a"]}`, `"a"`, nil},
+
+		{"properties valid", `{"properties":{"a":{"type":"integer"}}}`, `{"a":1,"b":"x"}`, nil},
+		{"properties invalid", `{"properties":{"a":{"type":"integer"}}}`, `{"a":"x"}`, []string{"$.a: must be of type integer, not string"}},
+		{"nested properties", `{"properties":{"a":{"properties":{"b":{"type":"boolean"}}}}}`, `{"a":{"b":1}}`, []string{"$.a.b: must be of type boolean, not integer"}},
+
+		{"additionalProperties false", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"b":2}`, []string{"$.b: is not an allowed property"}},
+		{"additionalProperties schema", `{"additionalProperties":{"type":"string"}}`, `{"a":"x","b":2}`, []string{"$.b: must be of type string, not integer"}},
+		{"additionalProperties true", `{"additionalProperties":true}`, `{"a":1}`, nil},
+
+		{"enum match", `{"enum":["a",1,null]}`, `1`, nil},
+		{"enum mismatch", `{"enum":["a",1]}`, `"b"`, []string{`$: must be one of ["a",1]`}},
+		{"enum compares objects", `{"enum":[{"a":[1]}]}`, `{"a":[1]}`, nil},
+		{"const", `{"const":"a"}`, `"b"`, []string{`$: must be "a"`}},
+
+		{"minimum", `{"minimum":8}`, `7`, []string{"$: must be at least 8"}},
+		{"minimum equal", `{"minimum":8}`, `8`, nil},
+		{"maximum", `{"maximum":8}`, `9`, []string{"$: must be at most 8"}},
+		{"draft 4 exclusiveMinimum", `{"minimum":8,"exclusiveMinimum":true}`, `8`, []string{"$: must be greater than 8"}},
+		{"exclusiveMaximum", `{"exclusiveMaximum":8}`, `8`, []string{"$: must be less than 8"}},
+		{"draft 4 exclusive false", `{"maximum":8,"exclusiveMaximum":false}`, `8`, nil},
+		{"multipleOf", `{"multipleOf":2}`, `3`, []string{"$: must be a multiple of 2"}},
+		{"minLength counts characters", `{"minLength":2}`, `"é"`, []string{"$: must be at least 2 characters long"}},
+		{"maxLength", `{"maxLength":2}`, `"abc"`, []string{"$: must be at most 2 characters long"}},
+		{"minProperties", `{"minProperties":1}`, `{}`, []string{"$: must have at least 1 properties"}},
+		{"maxProperties", `{"maxProperties":1}`, `{"a":1,"b":2}`, []string{"$: must have at most 1 properties"}},
+		{"minItems", `{"minItems":1}`, `[]`, []string{"$: must have at least 1 items"}},
+		{"maxItems", `{"maxItems":1}`, `[1,2]`, []string{"$: must have at most 1 items"}},
+
+		{"pattern match", `{"pattern":"^[a-z]+$"}`, `"abc"`, nil},
+		{"pattern mismatch", `{"pattern":"^[a-z]+$"}`, `"aBc"`, []string{`$: must match the pattern "^[a-z]+$"`}},
+		{"pattern is not anchored", `{"pattern":"b"}`, `"abc"`, nil},
+
+		{"items valid", `{"items":{"type":"string"}}`, `["a","b"]`, nil},
+		{"items invalid", `{"items":{"type":"string"}}`, `["a",1]`, []string{"$[1]: must be of type string, not integer"}},
+		{"uniqueItems", `{"uniqueItems":true}`, `[1,2,1]`, []string{"$[2]: duplicates item 0"}},
+
+		{"allOf", `{"allOf":[{"minimum":1},{"maximum":0}]}`, `2`, []string{"$: must be at most 0"}},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"type":"boolean"}]}`, `1`, []string{"$: must match at least one of the schemas in anyOf"}},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":0}]}`, `1`, []string{"$: must match exactly one of the schemas in oneOf, matched 2"}},
+		{"not", `{"not":{"type":"null"}}`, `null`, []string{"$: must not match the schema in not"}},
+
+		{"true schema", `true`, `{"a":1}`, nil},
+		{"false schema", `false`, `1`, []string{"$: is not allowed"}},
+		{"annotations are ignored", `{"$schema":"http://json-schema.org/draft-04/schema#","title":"t","description":"d","default":1}`, `2`, nil},
+		{"every violation is returned", `{"properties":{"a":{"type":"string"},"b":{"minimum":1}},"required":["c"]}`, `{"a":1,"b":0}`, []string{
+			"$.c: is required",
+			"$.a: must be of type string, not integer",
+			"$.b: must be at least 1",
+		}},
+	} {
+		schema, err := Compile(decode(t, test.schema))
+		if err != nil {
+			t.Errorf("%s: unexpected compile error %s", test.name, err)
+			continue
+		}
+
+		violations := []string{}
+		for _, violation := range schema.Validate(decode(t, test.document)) {
+			violations = append(violations, violation.String())
+		}
+		if test.violations == nil {
+			test.violations = []string{}
+		}
+		if !reflect.DeepEqual(violations, test.violations) {
+			t.Errorf("%s: expected %q, got %q", test.name, test.violations, violations)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, test := range []struct {
+		schema string
+		err    string
+	}{
+		{`"object"`, "#: a schema must be an object or a boolean"},
+		{`{"type":"map"}`, `#/type: unknown type "map"`},
+		{`{"type":1}`, "#/type: must be an array of strings"},
+		{`{"enum":[]}`, "#/enum: must be a non-empty array"},
+		{`{"required":["a",1]}`, "#/required: must be an array of strings"},
+		{`{"properties":[]}`, "#/properties: must be an object"},
+		{`{"properties":{"a":{"type":"map"}}}`, `#/properties/a/type: unknown type "map"`},
+		{`{"items":[{"type":"string"}]}`, "#/items: a schema must be an object or a boolean"},
+		{`{"minLength":-1}`, "#/minLength: must be a non-negative integer"},
+		{`{"maxItems":1.5}`, "#/maxItems: must be a non-negative integer"},
+		{`{"minimum":"1"}`, "#/minimum: must be a number"},
+		{`{"exclusiveMinimum":true}`, "#/exclusiveMinimum: requires minimum"},
+		{`{"multipleOf":0}`, "#/multipleOf: must be greater than 0"},
+		{`{"pattern":"("}`, "#/pattern: error parsing regexp: missing closing ): `(`"},
+		{`{"uniqueItems":"yes"}`, "#/uniqueItems: must be a boolean"},
+		{`{"anyOf":[]}`, "#/anyOf: must be a non-empty array"},
+		{`{"$ref":"#/definitions/a"}`, "#/$ref: unsupported keyword"},
+		{`{"patternProperties":{}}`, "#/patternProperties: unsupported keyword"},
+	} {
+		_, err := Compile(decode(t, test.schema))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %v", test.schema, test.err, err)
+		}
+	}
+}
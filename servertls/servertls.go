@@ -0,0 +1,156 @@
+package servertls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type Config struct {
+	ClientCAFile string
+	MinVersion   string
+}
+
+// NewConfig builds a server TLS config whose certificate is served by the
+// given reloader. Clients must present a certificate signed by ClientCAFile
+// when it is set.
+func NewConfig(config Config, reloader *CertificateReloader) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if config.MinVersion != "" {
+		version, ok := versions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS version %q, expected one of 1.0, 1.1, 1.2 or 1.3", config.MinVersion)
+		}
+		minVersion = version
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// CertificateReloader serves a certificate and key pair from disk and picks
+// up new files when they change, so the certificate can be rotated without
+// a restart.
+type CertificateReloader struct {
+	CertFile string
+	KeyFile  string
+	Logger   lager.Logger
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	modified    [2]time.Time
+}
+
+func NewCertificateReloader(certFile, keyFile string, logger lager.Logger) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{CertFile: certFile, KeyFile: keyFile, Logger: logger}
+	if _, err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (reloader *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mutex.RLock()
+	defer reloader.mutex.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+// Reload loads the pair again if either file has changed since the last
+// load. A pair that fails to load leaves the current certificate in place.
+func (reloader *CertificateReloader) Reload() (bool, error) {
+	modified, err := reloader.modTimes()
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mutex.RLock()
+	unchanged := reloader.certificate != nil && modified == reloader.modified
+	reloader.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.CertFile, reloader.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	reloader.mutex.Lock()
+	reloader.certificate = &certificate
+	reloader.modified = modified
+	reloader.mutex.Unlock()
+
+	return true, nil
+}
+
+func (reloader *CertificateReloader) Run(interval time.Duration, stop <-chan struct{}) {
+	logger := reloader.Logger.Session("certificate-reloader")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			reloaded, err := reloader.Reload()
+			if err != nil {
+				logger.Error("reload-failed", err)
+				continue
+			}
+
+			if reloaded {
+				logger.Info("reloaded", lager.Data{"cert-file": reloader.CertFile})
+			}
+		}
+	}
+}
+
+func (reloader *CertificateReloader) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, path := range []string{reloader.CertFile, reloader.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+
+	return modified, nil
+}
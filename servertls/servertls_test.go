@@ -0,0 +1,274 @@
+package servertls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type keyPair struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newKeyPair issues a certificate for commonName, signed by parent or
+// self-signed when parent is nil.
+func newKeyPair(t *testing.T, commonName string, parent *keyPair) *keyPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &keyPair{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (pair *keyPair) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	certificate, err := tls.X509KeyPair(pair.certPEM, pair.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+// writeFile writes contents to path and gives it the modification time
+// modified, so reloads do not depend on the file system's timestamp precision.
+func writeFile(t *testing.T, path string, contents []byte, modified time.Time) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestReloader(t *testing.T, pair *keyPair) *CertificateReloader {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	modified := time.Now().Add(-time.Minute)
+	writeFile(t, certFile, pair.certPEM, modified)
+	writeFile(t, keyFile, pair.keyPEM, modified)
+
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+
+	reloader, err := NewCertificateReloader(certFile, keyFile, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reloader
+}
+
+func servedCommonName(t *testing.T, reloader *CertificateReloader) string {
+	t.Helper()
+	certificate, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloaderPicksUpChangedFiles(t *testing.T) {
+	ca := newKeyPair(t, "ca", nil)
+	reloader := newTestReloader(t, newKeyPair(t, "first", ca))
+
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Fatalf("expected the first certificate, got %q", name)
+	}
+	if reloaded, err := reloader.Reload(); err != nil || reloaded {
+		t.Errorf("expected unchanged files not to be reloaded, got %t and %v", reloaded, err)
+	}
+
+	second := newKeyPair(t, "second", ca)
+	writeFile(t, reloader.CertFile, second.certPEM, time.Now())
+	writeFile(t, reloader.KeyFile, second.keyPEM, time.Now())
+
+	if reloaded, err := reloader.Reload(); err != nil || !reloaded {
+		t.Fatalf("expected the changed files to be reloaded, got %t and %v", reloaded, err)
+	}
+	if name := servedCommonName(t, reloader); name != "second" {
+		t.Errorf("expected the second certificate, got %q", name)
+	}
+}
+
+func TestCertificateReloaderKeepsTheCertificateWhenAReloadFails(t *testing.T) {
+	ca := newKeyPair(t, "ca", nil)
+	reloader := newTestReloader(t, newKeyPair(t, "first", ca))
+
+	// a certificate written before its key does not match the old key
+	writeFile(t, reloader.CertFile, newKeyPair(t, "second", ca).certPEM, time.Now())
+	if _, err := reloader.Reload(); err == nil {
+		t.Error("expected a mismatched pair to fail to load")
+	}
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Errorf("expected the first certificate to stay in place, got %q", name)
+	}
+
+	if err := os.Remove(reloader.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloader.Reload(); err == nil {
+		t.Error("expected a missing key to fail to load")
+	}
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Errorf("expected the first certificate to stay in place, got %q", name)
+	}
+}
+
+func TestNewCertificateReloaderRequiresAPair(t *testing.T) {
+	dir := t.TempDir()
+	logger := lager.NewLogger("test")
+	if _, err := NewCertificateReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), logger); err == nil {
+		t.Error("expected missing files to be rejected")
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	ca := newKeyPair(t, "ca", nil)
+	reloader := newTestReloader(t, newKeyPair(t, "server", ca))
+
+	dir := t.TempDir()
+	caFile, emptyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "empty.pem")
+	writeFile(t, caFile, ca.certPEM, time.Now())
+	writeFile(t, emptyFile, []byte("not a certificate"), time.Now())
+
+	for _, test := range []struct {
+		name       string
+		config     Config
+		valid      bool
+		minVersion uint16
+		clientAuth tls.ClientAuthType
+	}{
+		{"defaults", Config{}, true, tls.VersionTLS12, tls.NoClientCert},
+		{"minimum version", Config{MinVersion: "1.3"}, true, tls.VersionTLS13, tls.NoClientCert},
+		{"client CA", Config{ClientCAFile: caFile}, true, tls.VersionTLS12, tls.RequireAndVerifyClientCert},
+		{"unknown version", Config{MinVersion: "1.4"}, false, 0, 0},
+		{"missing client CA", Config{ClientCAFile: filepath.Join(dir, "missing.pem")}, false, 0, 0},
+		{"client CA without certificates", Config{ClientCAFile: emptyFile}, false, 0, 0},
+	} {
+		tlsConfig, err := NewConfig(test.config, reloader)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if tlsConfig.MinVersion != test.minVersion || tlsConfig.ClientAuth != test.clientAuth {
+			t.Errorf("%s: expected version %x and client auth %d, got %x and %d", test.name, test.minVersion, test.clientAuth, tlsConfig.MinVersion, tlsConfig.ClientAuth)
+		}
+	}
+}
+
+func TestNewConfigVerifiesClientCertificates(t *testing.T) {
+	ca := newKeyPair(t, "ca", nil)
+	reloader := newTestReloader(t, newKeyPair(t, "127.0.0.1", ca))
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, ca.certPEM, time.Now())
+	tlsConfig, err := NewConfig(Config{ClientCAFile: caFile}, reloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// httptest.Server.StartTLS serves its own certificate, so the config is
+	// applied to the listener instead
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Listener = tls.NewListener(server.Listener, tlsConfig)
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.Start()
+	defer server.Close()
+	url := "https://" + server.Listener.Addr().String()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(ca.certificate)
+
+	for _, test := range []struct {
+		name     string
+		client   *keyPair
+		accepted bool
+	}{
+		{"trusted client", newKeyPair(t, "client", ca), true},
+		{"no client certificate", nil, false},
+		{"untrusted client", newKeyPair(t, "client", newKeyPair(t, "other-ca", nil)), false},
+	} {
+		clientConfig := &tls.Config{RootCAs: serverCAs}
+		if test.client != nil {
+			clientConfig.Certificates = []tls.Certificate{test.client.tlsCertificate(t)}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+
+		response, err := client.Get(url)
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err == nil) != test.accepted {
+			t.Errorf("%s: expected accepted %t, got %v", test.name, test.accepted, err)
+		}
+	}
+}
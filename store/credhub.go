@@ -0,0 +1,175 @@
+package store
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+// CredHubStore is a Store backed by a live CredHub server.
+type CredHubStore struct {
+	CredHubClient *credhub.CredHub
+}
+
+func NewCredHubStore(credHubClient *credhub.CredHub) *CredHubStore {
+	return &CredHubStore{CredHubClient: credHubClient}
+}
+
+func (credHubStore *CredHubStore) SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error) {
+	cred, err := credHubStore.CredHubClient.SetValue(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	cred, err := credHubStore.CredHubClient.SetJSON(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetPassword(name string, value values.Password, mode credhub.Mode) (credentials.Password, error) {
+	cred, err := credHubStore.CredHubClient.SetPassword(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetUser(name string, value values.User, mode credhub.Mode) (credentials.User, error) {
+	cred, err := credHubStore.CredHubClient.SetUser(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetCertificate(name string, value values.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	cred, err := credHubStore.CredHubClient.SetCertificate(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetRSA(name string, value values.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	cred, err := credHubStore.CredHubClient.SetRSA(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) SetSSH(name string, value values.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	cred, err := credHubStore.CredHubClient.SetSSH(name, value, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	cred, err := credHubStore.CredHubClient.GeneratePassword(name, gen, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GenerateUser(name string, gen generate.User, mode credhub.Mode) (credentials.User, error) {
+	cred, err := credHubStore.CredHubClient.GenerateUser(name, gen, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GenerateCertificate(name string, gen generate.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	cred, err := credHubStore.CredHubClient.GenerateCertificate(name, gen, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GenerateRSA(name string, gen generate.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	cred, err := credHubStore.CredHubClient.GenerateRSA(name, gen, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GenerateSSH(name string, gen generate.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	cred, err := credHubStore.CredHubClient.GenerateSSH(name, gen, mode)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) Regenerate(name string) (credentials.Credential, error) {
+	cred, err := credHubStore.CredHubClient.Regenerate(name)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetLatestValue(name string) (credentials.Value, error) {
+	cred, err := credHubStore.CredHubClient.GetLatestValue(name)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetLatestJSON(name string) (credentials.JSON, error) {
+	cred, err := credHubStore.CredHubClient.GetLatestJSON(name)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetLatestVersion(name string) (credentials.Credential, error) {
+	cred, err := credHubStore.CredHubClient.GetLatestVersion(name)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetById(id string) (credentials.Credential, error) {
+	cred, err := credHubStore.CredHubClient.GetById(id)
+	return cred, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetAllVersions(name string) ([]credentials.Credential, error) {
+	creds, err := credHubStore.CredHubClient.GetAllVersions(name)
+	return creds, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetNVersions(name string, numberOfVersions int) ([]credentials.Credential, error) {
+	creds, err := credHubStore.CredHubClient.GetNVersions(name, numberOfVersions)
+	return creds, translateError(err)
+}
+
+func (credHubStore *CredHubStore) Delete(name string) error {
+	return translateError(credHubStore.CredHubClient.Delete(name))
+}
+
+func (credHubStore *CredHubStore) FindByPath(path string) (credentials.FindResults, error) {
+	results, err := credHubStore.CredHubClient.FindByPath(path)
+	return results, translateError(err)
+}
+
+func (credHubStore *CredHubStore) FindAllPaths() (credentials.Paths, error) {
+	paths, err := credHubStore.CredHubClient.FindAllPaths()
+	return paths, translateError(err)
+}
+
+func (credHubStore *CredHubStore) GetPermissions(name string) ([]permissions.Permission, error) {
+	perms, err := credHubStore.CredHubClient.GetPermissions(name)
+	return perms, translateError(err)
+}
+
+func (credHubStore *CredHubStore) AddPermissions(name string, perms []permissions.Permission) error {
+	_, err := credHubStore.CredHubClient.AddPermissions(name, perms)
+	return translateError(err)
+}
+
+// DeletePermissions calls the permissions API directly as the vendored client
+// does not implement it yet.
+func (credHubStore *CredHubStore) DeletePermissions(name string, actor string) error {
+	query := url.Values{}
+	query.Set("credential_name", name)
+	query.Set("actor", actor)
+
+	resp, err := credHubStore.CredHubClient.Request(http.MethodDelete, "/api/v1/permissions", query, nil)
+	if err != nil {
+		return translateError(err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func translateError(err error) error {
+	credHubErr, ok := err.(*credhub.Error)
+	if !ok {
+		return err
+	}
+
+	switch {
+	case strings.Contains(credHubErr.Name, "does not exist"):
+		return ErrNotFound
+	case strings.Contains(credHubErr.Name, "type cannot be modified"):
+		return ErrTypeModified
+	case strings.Contains(credHubErr.Name, "value was statically set"):
+		return ErrNotGenerated
+	}
+
+	return err
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"time"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+// Observer is told the method, duration and error of every call made through
+// an InstrumentedStore.
+type Observer interface {
+	ObserveCall(method string, duration time.Duration, err error)
+}
+
+// InstrumentedStore passes every call on to Store and reports it to Observer.
+type InstrumentedStore struct {
+	Store    Store
+	Observer Observer
+}
+
+func NewInstrumentedStore(store Store, observer Observer) *InstrumentedStore {
+	return &InstrumentedStore{Store: store, Observer: observer}
+}
+
+func (instrumentedStore *InstrumentedStore) SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetValue(name, value, mode)
+	instrumentedStore.observe("SetValue", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetJSON(name, value, mode)
+	instrumentedStore.observe("SetJSON", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetPassword(name string, value values.Password, mode credhub.Mode) (credentials.Password, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetPassword(name, value, mode)
+	instrumentedStore.observe("SetPassword", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetUser(name string, value values.User, mode credhub.Mode) (credentials.User, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetUser(name, value, mode)
+	instrumentedStore.observe("SetUser", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetCertificate(name string, value values.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetCertificate(name, value, mode)
+	instrumentedStore.observe("SetCertificate", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetRSA(name string, value values.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetRSA(name, value, mode)
+	instrumentedStore.observe("SetRSA", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) SetSSH(name string, value values.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.SetSSH(name, value, mode)
+	instrumentedStore.observe("SetSSH", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GeneratePassword(name, gen, mode)
+	instrumentedStore.observe("GeneratePassword", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GenerateUser(name string, gen generate.User, mode credhub.Mode) (credentials.User, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GenerateUser(name, gen, mode)
+	instrumentedStore.observe("GenerateUser", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GenerateCertificate(name string, gen generate.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GenerateCertificate(name, gen, mode)
+	instrumentedStore.observe("GenerateCertificate", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GenerateRSA(name string, gen generate.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GenerateRSA(name, gen, mode)
+	instrumentedStore.observe("GenerateRSA", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GenerateSSH(name string, gen generate.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GenerateSSH(name, gen, mode)
+	instrumentedStore.observe("GenerateSSH", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) Regenerate(name string) (credentials.Credential, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.Regenerate(name)
+	instrumentedStore.observe("Regenerate", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetLatestValue(name string) (credentials.Value, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetLatestValue(name)
+	instrumentedStore.observe("GetLatestValue", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetLatestJSON(name string) (credentials.JSON, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetLatestJSON(name)
+	instrumentedStore.observe("GetLatestJSON", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetLatestVersion(name string) (credentials.Credential, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetLatestVersion(name)
+	instrumentedStore.observe("GetLatestVersion", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetById(id string) (credentials.Credential, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetById(id)
+	instrumentedStore.observe("GetById", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetAllVersions(name string) ([]credentials.Credential, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetAllVersions(name)
+	instrumentedStore.observe("GetAllVersions", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetNVersions(name string, numberOfVersions int) ([]credentials.Credential, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetNVersions(name, numberOfVersions)
+	instrumentedStore.observe("GetNVersions", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) Delete(name string) error {
+	start := time.Now()
+	err := instrumentedStore.Store.Delete(name)
+	instrumentedStore.observe("Delete", start, err)
+	return err
+}
+
+func (instrumentedStore *InstrumentedStore) FindByPath(path string) (credentials.FindResults, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.FindByPath(path)
+	instrumentedStore.observe("FindByPath", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) FindAllPaths() (credentials.Paths, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.FindAllPaths()
+	instrumentedStore.observe("FindAllPaths", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) GetPermissions(name string) ([]permissions.Permission, error) {
+	start := time.Now()
+	result, err := instrumentedStore.Store.GetPermissions(name)
+	instrumentedStore.observe("GetPermissions", start, err)
+	return result, err
+}
+
+func (instrumentedStore *InstrumentedStore) AddPermissions(name string, perms []permissions.Permission) error {
+	start := time.Now()
+	err := instrumentedStore.Store.AddPermissions(name, perms)
+	instrumentedStore.observe("AddPermissions", start, err)
+	return err
+}
+
+func (instrumentedStore *InstrumentedStore) DeletePermissions(name string, actor string) error {
+	start := time.Now()
+	err := instrumentedStore.Store.DeletePermissions(name, actor)
+	instrumentedStore.observe("DeletePermissions", start, err)
+	return err
+}
+
+func (instrumentedStore *InstrumentedStore) observe(method string, start time.Time, err error) {
+	instrumentedStore.Observer.ObserveCall(method, time.Since(start), err)
+}
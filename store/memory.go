@@ -0,0 +1,406 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+// MemoryStore is an in-memory Store for running the broker without a CredHub
+// server. Like CredHub it keeps every version of a credential and tracks
+// permissions per actor, and deleting a credential deletes its permissions.
+type MemoryStore struct {
+	mutex                sync.RWMutex
+	credentials          map[string][]credentials.Credential
+	permissions          map[string]map[string][]string
+	generationParameters map[string]interface{}
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		credentials:          map[string][]credentials.Credential{},
+		permissions:          map[string]map[string][]string{},
+		generationParameters: map[string]interface{}{},
+	}
+}
+
+func (memoryStore *MemoryStore) SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error) {
+	var cred credentials.Value
+	err := memoryStore.set(name, "value", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	var cred credentials.JSON
+	err := memoryStore.set(name, "json", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetPassword(name string, value values.Password, mode credhub.Mode) (credentials.Password, error) {
+	var cred credentials.Password
+	err := memoryStore.set(name, "password", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetUser(name string, value values.User, mode credhub.Mode) (credentials.User, error) {
+	var cred credentials.User
+	err := memoryStore.set(name, "user", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetCertificate(name string, value values.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	var cred credentials.Certificate
+	err := memoryStore.set(name, "certificate", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetRSA(name string, value values.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	var cred credentials.RSA
+	err := memoryStore.set(name, "rsa", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) SetSSH(name string, value values.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	var cred credentials.SSH
+	err := memoryStore.set(name, "ssh", value, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GetLatestValue(name string) (credentials.Value, error) {
+	var cred credentials.Value
+	err := memoryStore.getLatest(name, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GetLatestJSON(name string) (credentials.JSON, error) {
+	var cred credentials.JSON
+	err := memoryStore.getLatest(name, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GetLatestVersion(name string) (credentials.Credential, error) {
+	var cred credentials.Credential
+	err := memoryStore.getLatest(name, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GetById(id string) (credentials.Credential, error) {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	for _, versions := range memoryStore.credentials {
+		for _, version := range versions {
+			if version.Id == id {
+				var cred credentials.Credential
+				err := convert(version, &cred)
+				return cred, err
+			}
+		}
+	}
+
+	return credentials.Credential{}, ErrNotFound
+}
+
+// GetAllVersions returns every version of a credential, newest first.
+func (memoryStore *MemoryStore) GetAllVersions(name string) ([]credentials.Credential, error) {
+	return memoryStore.GetNVersions(name, 0)
+}
+
+// GetNVersions returns the newest versions of a credential, newest first. A
+// count of zero or less returns every version.
+func (memoryStore *MemoryStore) GetNVersions(name string, numberOfVersions int) ([]credentials.Credential, error) {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	versions, ok := memoryStore.credentials[normalizeName(name)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	creds := []credentials.Credential{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if numberOfVersions > 0 && len(creds) == numberOfVersions {
+			break
+		}
+
+		var cred credentials.Credential
+		if err := convert(versions[i], &cred); err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+
+	return creds, nil
+}
+
+func (memoryStore *MemoryStore) Delete(name string) error {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	name = normalizeName(name)
+	if _, ok := memoryStore.credentials[name]; !ok {
+		return ErrNotFound
+	}
+
+	delete(memoryStore.credentials, name)
+	delete(memoryStore.permissions, name)
+	delete(memoryStore.generationParameters, name)
+	return nil
+}
+
+func (memoryStore *MemoryStore) FindByPath(path string) (credentials.FindResults, error) {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	prefix := strings.TrimSuffix(normalizeName(path), "/") + "/"
+
+	results := credentials.FindResults{Credentials: []credentials.Base{}}
+	for name, versions := range memoryStore.credentials {
+		if strings.HasPrefix(name, prefix) {
+			results.Credentials = append(results.Credentials, versions[len(versions)-1].Base)
+		}
+	}
+
+	sort.Slice(results.Credentials, func(i, j int) bool {
+		return results.Credentials[i].Name < results.Credentials[j].Name
+	})
+	return results, nil
+}
+
+func (memoryStore *MemoryStore) FindAllPaths() (credentials.Paths, error) {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	seen := map[string]bool{}
+	for name := range memoryStore.credentials {
+		segments := strings.Split(strings.TrimPrefix(name, "/"), "/")
+		path := "/"
+		for _, segment := range segments[:len(segments)-1] {
+			path += segment + "/"
+			seen[path] = true
+		}
+	}
+
+	paths := credentials.Paths{Paths: []credentials.Path{}}
+	for path := range seen {
+		paths.Paths = append(paths.Paths, credentials.Path{Path: path})
+	}
+
+	sort.Slice(paths.Paths, func(i, j int) bool {
+		return paths.Paths[i].Path < paths.Paths[j].Path
+	})
+	return paths, nil
+}
+
+func (memoryStore *MemoryStore) GetPermissions(name string) ([]permissions.Permission, error) {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	name = normalizeName(name)
+	if _, ok := memoryStore.credentials[name]; !ok {
+		return nil, ErrNotFound
+	}
+
+	perms := []permissions.Permission{}
+	for actor, operations := range memoryStore.permissions[name] {
+		perms = append(perms, permissions.Permission{Actor: actor, Operations: append([]string{}, operations...)})
+	}
+
+	sort.Slice(perms, func(i, j int) bool {
+		return perms[i].Actor < perms[j].Actor
+	})
+	return perms, nil
+}
+
+func (memoryStore *MemoryStore) AddPermissions(name string, perms []permissions.Permission) error {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	name = normalizeName(name)
+	if _, ok := memoryStore.credentials[name]; !ok {
+		return ErrNotFound
+	}
+
+	if memoryStore.permissions[name] == nil {
+		memoryStore.permissions[name] = map[string][]string{}
+	}
+
+	for _, perm := range perms {
+		memoryStore.permissions[name][perm.Actor] = mergeOperations(memoryStore.permissions[name][perm.Actor], perm.Operations)
+	}
+	return nil
+}
+
+func (memoryStore *MemoryStore) DeletePermissions(name string, actor string) error {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	name = normalizeName(name)
+	if _, ok := memoryStore.permissions[name][actor]; !ok {
+		return ErrNotFound
+	}
+
+	delete(memoryStore.permissions[name], actor)
+	return nil
+}
+
+func (memoryStore *MemoryStore) set(name, credType string, value interface{}, mode credhub.Mode, cred interface{}) error {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	var genericValue interface{}
+	if err := convert(value, &genericValue); err != nil {
+		return err
+	}
+
+	name = normalizeName(name)
+	versions := memoryStore.credentials[name]
+
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		unchanged := latest.Type == credType && reflect.DeepEqual(latest.Value, genericValue)
+
+		if mode == credhub.NoOverwrite || (mode == credhub.Converge && unchanged) {
+			return convert(latest, cred)
+		}
+		if latest.Type != credType {
+			return ErrTypeModified
+		}
+	}
+
+	delete(memoryStore.generationParameters, name)
+	return convert(memoryStore.addVersion(name, credType, genericValue), cred)
+}
+
+func (memoryStore *MemoryStore) generate(name string, params interface{}, mode credhub.Mode, cred interface{}) error {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	version, err := memoryStore.generateVersion(normalizeName(name), params, mode)
+	if err != nil {
+		return err
+	}
+	return convert(version, cred)
+}
+
+// generateVersion must be called with the mutex held.
+func (memoryStore *MemoryStore) generateVersion(name string, params interface{}, mode credhub.Mode) (credentials.Credential, error) {
+	credType, generator, err := memoryStore.generator(params)
+	if err != nil {
+		return credentials.Credential{}, err
+	}
+
+	versions := memoryStore.credentials[name]
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		unchanged := latest.Type == credType && reflect.DeepEqual(memoryStore.generationParameters[name], params)
+
+		if mode == credhub.NoOverwrite || (mode == credhub.Converge && unchanged) {
+			return latest, nil
+		}
+		if latest.Type != credType {
+			return credentials.Credential{}, ErrTypeModified
+		}
+	}
+
+	value, err := generator()
+	if err != nil {
+		return credentials.Credential{}, err
+	}
+
+	var genericValue interface{}
+	if err := convert(value, &genericValue); err != nil {
+		return credentials.Credential{}, err
+	}
+
+	memoryStore.generationParameters[name] = params
+	return memoryStore.addVersion(name, credType, genericValue), nil
+}
+
+// addVersion must be called with the mutex held.
+func (memoryStore *MemoryStore) addVersion(name, credType string, value interface{}) credentials.Credential {
+	version := credentials.Credential{
+		Metadata: credentials.Metadata{
+			Id: NewID(),
+			Base: credentials.Base{
+				Name:             name,
+				VersionCreatedAt: time.Now().UTC().Format(time.RFC3339),
+			},
+			Type: credType,
+		},
+		Value: value,
+	}
+	memoryStore.credentials[name] = append(memoryStore.credentials[name], version)
+
+	return version
+}
+
+func (memoryStore *MemoryStore) getLatest(name string, cred interface{}) error {
+	memoryStore.mutex.RLock()
+	defer memoryStore.mutex.RUnlock()
+
+	versions, ok := memoryStore.credentials[normalizeName(name)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	return convert(versions[len(versions)-1], cred)
+}
+
+// convert round-trips through JSON so callers get the same decoding
+// behaviour, including type mismatches, as they would from the CredHub API.
+func convert(from interface{}, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, to)
+}
+
+func mergeOperations(existing []string, additional []string) []string {
+	merged := append([]string{}, existing...)
+	for _, operation := range additional {
+		found := false
+		for _, e := range merged {
+			if e == operation {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, operation)
+		}
+	}
+	return merged
+}
+
+func normalizeName(name string) string {
+	if !strings.HasPrefix(name, "/") {
+		return "/" + name
+	}
+	return name
+}
+
+// NewID returns a random version 4 UUID, the form of the IDs CredHub gives
+// credential versions. It panics when the system's random source fails, as
+// IDs that may repeat would let records overwrite each other.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes for an ID: " + err.Error())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,345 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+const (
+	defaultPasswordLength = 30
+	defaultKeyLength      = 2048
+	defaultDurationDays   = 365
+
+	lowerCharacters   = "abcdefghijklmnopqrstuvwxyz"
+	upperCharacters   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	numberCharacters  = "0123456789"
+	specialCharacters = "!\"#$%&'()*,-./:;<=>?@[\\]^_`{|}~"
+)
+
+func (memoryStore *MemoryStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	var cred credentials.Password
+	err := memoryStore.generate(name, gen, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GenerateUser(name string, gen generate.User, mode credhub.Mode) (credentials.User, error) {
+	var cred credentials.User
+	err := memoryStore.generate(name, gen, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GenerateRSA(name string, gen generate.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	var cred credentials.RSA
+	err := memoryStore.generate(name, gen, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GenerateSSH(name string, gen generate.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	var cred credentials.SSH
+	err := memoryStore.generate(name, gen, mode, &cred)
+	return cred, err
+}
+
+func (memoryStore *MemoryStore) GenerateCertificate(name string, gen generate.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	var cred credentials.Certificate
+	err := memoryStore.generate(name, gen, mode, &cred)
+	return cred, err
+}
+
+// Regenerate generates a new version of a credential with the parameters it
+// was last generated with.
+func (memoryStore *MemoryStore) Regenerate(name string) (credentials.Credential, error) {
+	memoryStore.mutex.Lock()
+	defer memoryStore.mutex.Unlock()
+
+	name = normalizeName(name)
+	if _, exists := memoryStore.credentials[name]; !exists {
+		return credentials.Credential{}, ErrNotFound
+	}
+
+	params, generated := memoryStore.generationParameters[name]
+	if !generated {
+		return credentials.Credential{}, ErrNotGenerated
+	}
+
+	return memoryStore.generateVersion(name, params, credhub.Overwrite)
+}
+
+// generator returns the type of credential generated from params and the
+// function that generates its value, which must be called with the mutex
+// held.
+func (memoryStore *MemoryStore) generator(params interface{}) (string, func() (interface{}, error), error) {
+	switch gen := params.(type) {
+	case generate.Password:
+		return "password", func() (interface{}, error) {
+			return randomPassword(gen.Length, gen.IncludeSpecial, gen.ExcludeNumber, gen.ExcludeUpper, gen.ExcludeLower)
+		}, nil
+	case generate.User:
+		return "user", func() (interface{}, error) {
+			username := gen.Username
+			if username == "" {
+				username, _ = randomString(20, lowerCharacters)
+			}
+
+			password, err := randomPassword(gen.Length, gen.IncludeSpecial, gen.ExcludeNumber, gen.ExcludeUpper, gen.ExcludeLower)
+			if err != nil {
+				return nil, err
+			}
+
+			return values.User{Username: username, Password: password}, nil
+		}, nil
+	case generate.RSA:
+		return "rsa", func() (interface{}, error) {
+			key, err := rsa.GenerateKey(rand.Reader, keyLength(gen.KeyLength))
+			if err != nil {
+				return nil, err
+			}
+
+			publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+
+			return values.RSA{
+				PublicKey:  encodePEM("PUBLIC KEY", publicKey),
+				PrivateKey: encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+			}, nil
+		}, nil
+	case generate.SSH:
+		return "ssh", func() (interface{}, error) {
+			key, err := rsa.GenerateKey(rand.Reader, keyLength(gen.KeyLength))
+			if err != nil {
+				return nil, err
+			}
+
+			publicKey := "ssh-rsa " + base64.StdEncoding.EncodeToString(sshPublicKey(&key.PublicKey))
+			if gen.Comment != "" {
+				publicKey += " " + gen.Comment
+			}
+
+			return values.SSH{
+				PublicKey:  publicKey,
+				PrivateKey: encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+			}, nil
+		}, nil
+	case generate.Certificate:
+		return "certificate", func() (interface{}, error) {
+			return memoryStore.generateCertificate(gen)
+		}, nil
+	}
+
+	return "", nil, ErrNotGenerated
+}
+
+// generateCertificate must be called with the mutex held.
+func (memoryStore *MemoryStore) generateCertificate(gen generate.Certificate) (values.Certificate, error) {
+	if gen.Ca == "" && !gen.SelfSign && !gen.IsCA {
+		return values.Certificate{}, errors.New("certificates must be self-signed, a CA, or signed by a named CA")
+	}
+	if gen.CommonName == "" && len(gen.AlternativeNames) == 0 {
+		return values.Certificate{}, errors.New("a common name or alternative name is required")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, keyLength(gen.KeyLength))
+	if err != nil {
+		return values.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return values.Certificate{}, err
+	}
+
+	duration := gen.Duration
+	if duration == 0 {
+		duration = defaultDurationDays
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:         gen.CommonName,
+			Organization:       nonEmpty(gen.Organization),
+			OrganizationalUnit: nonEmpty(gen.OrganizationUnit),
+			Locality:           nonEmpty(gen.Locality),
+			Province:           nonEmpty(gen.State),
+			Country:            nonEmpty(gen.Country),
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, duration),
+		BasicConstraintsValid: true,
+		IsCA:                  gen.IsCA,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if gen.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	for _, alternativeName := range gen.AlternativeNames {
+		if ip := net.ParseIP(alternativeName); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, alternativeName)
+		}
+	}
+
+	parent := template
+	var signer interface{} = key
+	caPEM := ""
+
+	if gen.Ca != "" {
+		ca, err := memoryStore.latestCertificate(gen.Ca)
+		if err != nil {
+			return values.Certificate{}, err
+		}
+
+		parent, signer, err = parseCertificateAndKey(ca.Certificate, ca.PrivateKey)
+		if err != nil {
+			return values.Certificate{}, err
+		}
+		caPEM = ca.Certificate
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		return values.Certificate{}, err
+	}
+
+	certificate := encodePEM("CERTIFICATE", der)
+	if caPEM == "" {
+		caPEM = certificate
+	}
+
+	return values.Certificate{
+		Ca:          caPEM,
+		CaName:      gen.Ca,
+		Certificate: certificate,
+		PrivateKey:  encodePEM("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)),
+	}, nil
+}
+
+// latestCertificate must be called with the mutex held.
+func (memoryStore *MemoryStore) latestCertificate(name string) (values.Certificate, error) {
+	versions, ok := memoryStore.credentials[normalizeName(name)]
+	if !ok {
+		return values.Certificate{}, ErrNotFound
+	}
+
+	var cred credentials.Certificate
+	if err := convert(versions[len(versions)-1], &cred); err != nil {
+		return values.Certificate{}, err
+	}
+
+	return cred.Value, nil
+}
+
+func parseCertificateAndKey(certificatePEM, privateKeyPEM string) (*x509.Certificate, interface{}, error) {
+	certBlock, _ := pem.Decode([]byte(certificatePEM))
+	keyBlock, _ := pem.Decode([]byte(privateKeyPEM))
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("CA certificate or key is not valid PEM")
+	}
+
+	certificate, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certificate, key, nil
+}
+
+func randomPassword(length int, includeSpecial, excludeNumber, excludeUpper, excludeLower bool) (string, error) {
+	if length == 0 {
+		length = defaultPasswordLength
+	}
+
+	charset := ""
+	if !excludeLower {
+		charset += lowerCharacters
+	}
+	if !excludeUpper {
+		charset += upperCharacters
+	}
+	if !excludeNumber {
+		charset += numberCharacters
+	}
+	if includeSpecial {
+		charset += specialCharacters
+	}
+	if charset == "" {
+		return "", errors.New("at least one character class must be included")
+	}
+
+	return randomString(length, charset)
+}
+
+func randomString(length int, charset string) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = charset[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// sshPublicKey encodes an RSA public key in the OpenSSH wire format.
+func sshPublicKey(key *rsa.PublicKey) []byte {
+	encoded := []byte{}
+	for _, field := range [][]byte{[]byte("ssh-rsa"), mpint(big.NewInt(int64(key.E))), mpint(key.N)} {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(field)))
+		encoded = append(encoded, length...)
+		encoded = append(encoded, field...)
+	}
+	return encoded
+}
+
+func mpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return b
+}
+
+func encodePEM(blockType string, der []byte) string {
+	return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})))
+}
+
+func keyLength(length int) int {
+	if length == 0 {
+		return defaultKeyLength
+	}
+	return length
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return []string{value}
+}
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+func TestMemoryStoreWriteModes(t *testing.T) {
+	for _, test := range []struct {
+		mode     credhub.Mode
+		value    string
+		versions int
+		latest   string
+	}{
+		{credhub.Overwrite, "first", 2, "first"},
+		{credhub.Overwrite, "second", 2, "second"},
+		{credhub.NoOverwrite, "second", 1, "first"},
+		{credhub.Converge, "first", 1, "first"},
+		{credhub.Converge, "second", 2, "second"},
+	} {
+		memoryStore := NewMemoryStore()
+		first, err := memoryStore.SetValue("/a", values.Value("first"), credhub.Overwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cred, err := memoryStore.SetValue("/a", values.Value(test.value), test.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(cred.Value) != test.latest {
+			t.Errorf("%s %s: expected %q to be returned, got %q", test.mode, test.value, test.latest, cred.Value)
+		}
+		if kept := cred.Id == first.Id; kept != (test.versions == 1) {
+			t.Errorf("%s %s: expected a new version %t, got id %s after %s", test.mode, test.value, test.versions == 2, cred.Id, first.Id)
+		}
+
+		versions, err := memoryStore.GetAllVersions("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) != test.versions {
+			t.Errorf("%s %s: expected %d versions, got %d", test.mode, test.value, test.versions, len(versions))
+		}
+	}
+}
+
+func TestMemoryStoreRejectsTypeChanges(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	if _, err := memoryStore.SetValue("/a", values.Value("value"), credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := memoryStore.SetJSON("/a", values.JSON{"a": 1}, credhub.Overwrite); err != ErrTypeModified {
+		t.Errorf("expected ErrTypeModified, got %v", err)
+	}
+	if _, err := memoryStore.GeneratePassword("/a", generate.Password{}, credhub.Converge); err != ErrTypeModified {
+		t.Errorf("expected ErrTypeModified, got %v", err)
+	}
+}
+
+func TestMemoryStoreVersions(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	ids := []string{}
+	for _, value := range []string{"one", "two", "three"} {
+		cred, err := memoryStore.SetValue("a", values.Value(value), credhub.Overwrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cred.Name != "/a" {
+			t.Errorf("expected the name to be normalized to /a, got %q", cred.Name)
+		}
+		ids = append(ids, cred.Id)
+	}
+
+	for _, test := range []struct {
+		count  int
+		values []interface{}
+	}{
+		{0, []interface{}{"three", "two", "one"}},
+		{2, []interface{}{"three", "two"}},
+		{5, []interface{}{"three", "two", "one"}},
+	} {
+		versions, err := memoryStore.GetNVersions("/a", test.count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []interface{}{}
+		for _, version := range versions {
+			got = append(got, version.Value)
+		}
+		if !reflect.DeepEqual(got, test.values) {
+			t.Errorf("%d versions: expected %v, got %v", test.count, test.values, got)
+		}
+	}
+
+	cred, err := memoryStore.GetById(ids[1])
+	if err != nil || cred.Value != "two" {
+		t.Errorf("expected the second version by id, got %v and %v", cred.Value, err)
+	}
+	latest, err := memoryStore.GetLatestValue("/a")
+	if err != nil || latest.Value != "three" || latest.Id != ids[2] {
+		t.Errorf("expected the latest version, got %v and %v", latest, err)
+	}
+
+	if _, err := memoryStore.GetById("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an unknown id, got %v", err)
+	}
+	if _, err := memoryStore.GetNVersions("/missing", 1); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an unknown name, got %v", err)
+	}
+}
+
+func TestMemoryStoreGenerateConvergesOnParameters(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	first, err := memoryStore.GeneratePassword("/a", generate.Password{Length: 10}, credhub.Converge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.Value) != 10 {
+		t.Errorf("expected a 10 character password, got %q", first.Value)
+	}
+
+	same, err := memoryStore.GeneratePassword("/a", generate.Password{Length: 10}, credhub.Converge)
+	if err != nil || same.Id != first.Id {
+		t.Errorf("expected the same parameters to keep the version, got %v and %v", same.Id, err)
+	}
+	changed, err := memoryStore.GeneratePassword("/a", generate.Password{Length: 12}, credhub.Converge)
+	if err != nil || changed.Id == first.Id || len(changed.Value) != 12 {
+		t.Errorf("expected new parameters to generate a new version, got %v and %v", changed, err)
+	}
+
+	regenerated, err := memoryStore.Regenerate("/a")
+	if err != nil || regenerated.Id == changed.Id {
+		t.Errorf("expected a new version, got %v and %v", regenerated.Id, err)
+	}
+	if password, _ := regenerated.Value.(string); len(password) != 12 {
+		t.Errorf("expected the last parameters to be reused, got %v", regenerated.Value)
+	}
+
+	// setting a value replaces the generated one, so it cannot be regenerated
+	if _, err := memoryStore.SetPassword("/a", values.Password("static"), credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memoryStore.Regenerate("/a"); err != ErrNotGenerated {
+		t.Errorf("expected ErrNotGenerated, got %v", err)
+	}
+	if _, err := memoryStore.Regenerate("/missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestMemoryStoreSignsCertificatesWithANamedCA(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	ca, err := memoryStore.GenerateCertificate("/ca", generate.Certificate{CommonName: "ca", IsCA: true, SelfSign: true, KeyLength: 2048}, credhub.Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := memoryStore.GenerateCertificate("/leaf", generate.Certificate{CommonName: "leaf", Ca: "/ca", KeyLength: 2048}, credhub.Overwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.Value.Ca != ca.Value.Certificate || leaf.Value.CaName != "/ca" {
+		t.Errorf("expected the leaf to name its CA, got %q", leaf.Value.CaName)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(ca.Value.Certificate))
+	block, _ := pem.Decode([]byte(leaf.Value.Certificate))
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := certificate.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Errorf("expected the leaf to be signed by the CA: %s", err)
+	}
+
+	if _, err := memoryStore.GenerateCertificate("/orphan", generate.Certificate{CommonName: "orphan", Ca: "/missing"}, credhub.Overwrite); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing CA, got %v", err)
+	}
+	if _, err := memoryStore.GenerateCertificate("/unsigned", generate.Certificate{CommonName: "unsigned"}, credhub.Overwrite); err == nil {
+		t.Error("expected a certificate without a signer to be rejected")
+	}
+}
+
+func TestMemoryStorePermissions(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	if err := memoryStore.AddPermissions("/a", []permissions.Permission{{Actor: "app", Operations: []string{"read"}}}); err != ErrNotFound {
+		t.Errorf("expected permissions on a missing credential to fail, got %v", err)
+	}
+
+	if _, err := memoryStore.SetValue("/a", values.Value("value"), credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	for _, perms := range [][]permissions.Permission{
+		{{Actor: "b", Operations: []string{"read"}}},
+		{{Actor: "a", Operations: []string{"read", "write"}}, {Actor: "b", Operations: []string{"read", "delete"}}},
+	} {
+		if err := memoryStore.AddPermissions("/a", perms); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	perms, err := memoryStore.GetPermissions("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []permissions.Permission{
+		{Actor: "a", Operations: []string{"read", "write"}},
+		{Actor: "b", Operations: []string{"read", "delete"}},
+	}
+	if !reflect.DeepEqual(perms, expected) {
+		t.Errorf("expected merged operations %v, got %v", expected, perms)
+	}
+
+	// a new version keeps the permissions of the credential
+	if _, err := memoryStore.SetValue("/a", values.Value("new"), credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := memoryStore.DeletePermissions("/a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := memoryStore.DeletePermissions("/a", "a"); err != ErrNotFound {
+		t.Errorf("expected deleting a missing actor to fail, got %v", err)
+	}
+	perms, _ = memoryStore.GetPermissions("/a")
+	if len(perms) != 1 || perms[0].Actor != "b" {
+		t.Errorf("expected only b to remain, got %v", perms)
+	}
+
+	// deleting the credential deletes its permissions, so a credential created
+	// again at the same name does not inherit them
+	if err := memoryStore.Delete("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := memoryStore.Delete("/a"); err != ErrNotFound {
+		t.Errorf("expected deleting twice to fail, got %v", err)
+	}
+	if _, err := memoryStore.SetValue("/a", values.Value("again"), credhub.Overwrite); err != nil {
+		t.Fatal(err)
+	}
+	perms, err = memoryStore.GetPermissions("/a")
+	if err != nil || len(perms) != 0 {
+		t.Errorf("expected no permissions, got %v and %v", perms, err)
+	}
+	if versions, _ := memoryStore.GetAllVersions("/a"); len(versions) != 1 {
+		t.Errorf("expected the old versions to be deleted, got %d", len(versions))
+	}
+}
+
+func TestMemoryStoreFind(t *testing.T) {
+	memoryStore := NewMemoryStore()
+	for _, name := range []string{"/b/2", "/b/1", "/b/c/3", "/bb/4", "/5"} {
+		if _, err := memoryStore.SetValue(name, values.Value("value"), credhub.Overwrite); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := memoryStore.FindByPath("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, cred := range results.Credentials {
+		names = append(names, cred.Name)
+	}
+	if expected := []string{"/b/1", "/b/2", "/b/c/3"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	paths, err := memoryStore.FindAllPaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, path := range paths.Paths {
+		got = append(got, path.Path)
+	}
+	if expected := []string{"/b/", "/b/c/", "/bb/"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,454 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+// ErrTimeout is returned when a call takes longer than the configured
+// timeout. The call may still complete in CredHub.
+var ErrTimeout = errors.New("the call to CredHub timed out")
+
+// UnavailableError is returned without calling CredHub while the circuit
+// breaker is open.
+type UnavailableError struct {
+	RetryAfter time.Duration
+}
+
+func (err *UnavailableError) Error() string {
+	return "CredHub is unavailable, please retry later"
+}
+
+// IsTransient reports whether err means CredHub or UAA could not be reached
+// or did not answer properly, as opposed to CredHub rejecting the call.
+// Error bodies that are not JSON come from a proxy in front of CredHub.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == ErrTimeout || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	var unavailableErr *UnavailableError
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	return errors.As(err, &unavailableErr) || errors.As(err, &netErr) || errors.As(err, &syntaxErr)
+}
+
+type ResilienceConfig struct {
+	// Attempts is the most times a call is made.
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout limits each attempt, zero means no limit.
+	Timeout time.Duration
+	// FailureThreshold consecutive transient failures open the circuit
+	// breaker for Cooldown, after which a single call is let through to
+	// test CredHub.
+	FailureThreshold int
+	Cooldown         time.Duration
+}
+
+func DefaultResilienceConfig() ResilienceConfig {
+	return ResilienceConfig{
+		Attempts:         3,
+		BaseDelay:        100 * time.Millisecond,
+		MaxDelay:         2 * time.Second,
+		Timeout:          10 * time.Second,
+		FailureThreshold: 5,
+		Cooldown:         30 * time.Second,
+	}
+}
+
+// ResilienceObserver is told about retries, calls rejected by the circuit
+// breaker and changes to its state.
+type ResilienceObserver interface {
+	ObserveRetry(method string, err error)
+	ObserveRejected(method string)
+	ObserveCircuit(open bool)
+}
+
+// ResilientStore passes every call on to Store with a timeout, retries calls
+// that fail transiently and are safe to make again with jittered exponential
+// backoff, and stops calling Store while it keeps failing.
+type ResilientStore struct {
+	Store    Store
+	Config   ResilienceConfig
+	Observer ResilienceObserver
+	Logger   lager.Logger
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	testing   bool
+
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewResilientStore(store Store, config ResilienceConfig, observer ResilienceObserver, logger lager.Logger) *ResilientStore {
+	return &ResilientStore{
+		Store:    store,
+		Config:   config,
+		Observer: observer,
+		Logger:   logger.Session("credhub"),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// retryPolicy says which transient failures of a call are retried.
+type retryPolicy int
+
+const (
+	// retryTransient retries reads, which change nothing in CredHub.
+	retryTransient retryPolicy = iota
+	// retryUnlessTimedOut retries Set, Delete and permission calls unless
+	// they timed out. A call that timed out may still complete in CredHub,
+	// so making it again could fail as not found or conflicting.
+	retryUnlessTimedOut
+	// retryNever is used for Generate and Regenerate calls, as each attempt
+	// would produce a different value.
+	retryNever
+)
+
+// retries reports whether a call failing with err is made again.
+func (policy retryPolicy) retries(err error) bool {
+	switch policy {
+	case retryTransient:
+		return IsTransient(err)
+	case retryUnlessTimedOut:
+		var netErr net.Error
+		timedOut := err == ErrTimeout || (errors.As(err, &netErr) && netErr.Timeout())
+		return IsTransient(err) && !timedOut
+	}
+	return false
+}
+
+func (resilientStore *ResilientStore) SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error) {
+	result, err := resilientStore.call("SetValue", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetValue(name, value, mode)
+	})
+	typed, _ := result.(credentials.Value)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	result, err := resilientStore.call("SetJSON", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetJSON(name, value, mode)
+	})
+	typed, _ := result.(credentials.JSON)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetPassword(name string, value values.Password, mode credhub.Mode) (credentials.Password, error) {
+	result, err := resilientStore.call("SetPassword", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetPassword(name, value, mode)
+	})
+	typed, _ := result.(credentials.Password)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetUser(name string, value values.User, mode credhub.Mode) (credentials.User, error) {
+	result, err := resilientStore.call("SetUser", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetUser(name, value, mode)
+	})
+	typed, _ := result.(credentials.User)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetCertificate(name string, value values.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	result, err := resilientStore.call("SetCertificate", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetCertificate(name, value, mode)
+	})
+	typed, _ := result.(credentials.Certificate)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetRSA(name string, value values.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	result, err := resilientStore.call("SetRSA", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetRSA(name, value, mode)
+	})
+	typed, _ := result.(credentials.RSA)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) SetSSH(name string, value values.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	result, err := resilientStore.call("SetSSH", retryUnlessTimedOut, func() (interface{}, error) {
+		return resilientStore.Store.SetSSH(name, value, mode)
+	})
+	typed, _ := result.(credentials.SSH)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	result, err := resilientStore.call("GeneratePassword", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.GeneratePassword(name, gen, mode)
+	})
+	typed, _ := result.(credentials.Password)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GenerateUser(name string, gen generate.User, mode credhub.Mode) (credentials.User, error) {
+	result, err := resilientStore.call("GenerateUser", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.GenerateUser(name, gen, mode)
+	})
+	typed, _ := result.(credentials.User)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GenerateCertificate(name string, gen generate.Certificate, mode credhub.Mode) (credentials.Certificate, error) {
+	result, err := resilientStore.call("GenerateCertificate", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.GenerateCertificate(name, gen, mode)
+	})
+	typed, _ := result.(credentials.Certificate)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GenerateRSA(name string, gen generate.RSA, mode credhub.Mode) (credentials.RSA, error) {
+	result, err := resilientStore.call("GenerateRSA", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.GenerateRSA(name, gen, mode)
+	})
+	typed, _ := result.(credentials.RSA)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GenerateSSH(name string, gen generate.SSH, mode credhub.Mode) (credentials.SSH, error) {
+	result, err := resilientStore.call("GenerateSSH", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.GenerateSSH(name, gen, mode)
+	})
+	typed, _ := result.(credentials.SSH)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) Regenerate(name string) (credentials.Credential, error) {
+	result, err := resilientStore.call("Regenerate", retryNever, func() (interface{}, error) {
+		return resilientStore.Store.Regenerate(name)
+	})
+	typed, _ := result.(credentials.Credential)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetLatestValue(name string) (credentials.Value, error) {
+	result, err := resilientStore.call("GetLatestValue", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetLatestValue(name)
+	})
+	typed, _ := result.(credentials.Value)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetLatestJSON(name string) (credentials.JSON, error) {
+	result, err := resilientStore.call("GetLatestJSON", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetLatestJSON(name)
+	})
+	typed, _ := result.(credentials.JSON)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetLatestVersion(name string) (credentials.Credential, error) {
+	result, err := resilientStore.call("GetLatestVersion", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetLatestVersion(name)
+	})
+	typed, _ := result.(credentials.Credential)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetById(id string) (credentials.Credential, error) {
+	result, err := resilientStore.call("GetById", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetById(id)
+	})
+	typed, _ := result.(credentials.Credential)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetAllVersions(name string) ([]credentials.Credential, error) {
+	result, err := resilientStore.call("GetAllVersions", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetAllVersions(name)
+	})
+	typed, _ := result.([]credentials.Credential)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetNVersions(name string, numberOfVersions int) ([]credentials.Credential, error) {
+	result, err := resilientStore.call("GetNVersions", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetNVersions(name, numberOfVersions)
+	})
+	typed, _ := result.([]credentials.Credential)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) Delete(name string) error {
+	_, err := resilientStore.call("Delete", retryUnlessTimedOut, func() (interface{}, error) {
+		return nil, resilientStore.Store.Delete(name)
+	})
+	return err
+}
+
+func (resilientStore *ResilientStore) FindByPath(path string) (credentials.FindResults, error) {
+	result, err := resilientStore.call("FindByPath", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.FindByPath(path)
+	})
+	typed, _ := result.(credentials.FindResults)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) FindAllPaths() (credentials.Paths, error) {
+	result, err := resilientStore.call("FindAllPaths", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.FindAllPaths()
+	})
+	typed, _ := result.(credentials.Paths)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) GetPermissions(name string) ([]permissions.Permission, error) {
+	result, err := resilientStore.call("GetPermissions", retryTransient, func() (interface{}, error) {
+		return resilientStore.Store.GetPermissions(name)
+	})
+	typed, _ := result.([]permissions.Permission)
+	return typed, err
+}
+
+func (resilientStore *ResilientStore) AddPermissions(name string, perms []permissions.Permission) error {
+	_, err := resilientStore.call("AddPermissions", retryUnlessTimedOut, func() (interface{}, error) {
+		return nil, resilientStore.Store.AddPermissions(name, perms)
+	})
+	return err
+}
+
+func (resilientStore *ResilientStore) DeletePermissions(name string, actor string) error {
+	_, err := resilientStore.call("DeletePermissions", retryUnlessTimedOut, func() (interface{}, error) {
+		return nil, resilientStore.Store.DeletePermissions(name, actor)
+	})
+	return err
+}
+
+func (resilientStore *ResilientStore) call(method string, policy retryPolicy, attempt func() (interface{}, error)) (interface{}, error) {
+	logger := resilientStore.Logger.Session("call", lager.Data{"method": method})
+
+	for try := 1; ; try++ {
+		testing, retryAfter, allowed := resilientStore.allow()
+		if !allowed {
+			resilientStore.Observer.ObserveRejected(method)
+			return nil, &UnavailableError{RetryAfter: retryAfter}
+		}
+
+		result, err := resilientStore.withTimeout(attempt)
+		resilientStore.record(testing, err)
+
+		if !policy.retries(err) || try >= resilientStore.Config.Attempts {
+			return result, err
+		}
+
+		delay := resilientStore.backoff(try)
+		logger.Info("retrying", lager.Data{"attempt": try, "delay": delay.String(), "error": err.Error()})
+		resilientStore.Observer.ObserveRetry(method, err)
+		resilientStore.sleep(delay)
+	}
+}
+
+// withTimeout abandons an attempt that takes longer than the timeout, the
+// Store interface has no way to cancel it.
+func (resilientStore *ResilientStore) withTimeout(attempt func() (interface{}, error)) (interface{}, error) {
+	if resilientStore.Config.Timeout <= 0 {
+		return attempt()
+	}
+
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := attempt()
+		done <- outcome{result, err}
+	}()
+
+	timer := time.NewTimer(resilientStore.Config.Timeout)
+	defer timer.Stop()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// backoff returns a random delay of up to BaseDelay doubled for each attempt
+// made, capped at MaxDelay, so retries from many requests spread out.
+func (resilientStore *ResilientStore) backoff(try int) time.Duration {
+	ceiling := resilientStore.Config.BaseDelay
+	for i := 1; i < try && ceiling < resilientStore.Config.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > resilientStore.Config.MaxDelay {
+		ceiling = resilientStore.Config.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// allow reports whether a call may be made, and whether it tests CredHub
+// after the circuit breaker's cooldown. Otherwise it returns how long until
+// calls are let through again.
+func (resilientStore *ResilientStore) allow() (bool, time.Duration, bool) {
+	resilientStore.mutex.Lock()
+	defer resilientStore.mutex.Unlock()
+
+	if resilientStore.Config.FailureThreshold <= 0 || resilientStore.failures < resilientStore.Config.FailureThreshold {
+		return false, 0, true
+	}
+
+	if wait := resilientStore.openUntil.Sub(resilientStore.now()); wait > 0 {
+		return false, wait, false
+	}
+	if resilientStore.testing {
+		return false, time.Second, false
+	}
+
+	resilientStore.testing = true
+	return true, 0, true
+}
+
+func (resilientStore *ResilientStore) record(testing bool, err error) {
+	resilientStore.mutex.Lock()
+	defer resilientStore.mutex.Unlock()
+
+	if testing {
+		resilientStore.testing = false
+	}
+
+	threshold := resilientStore.Config.FailureThreshold
+	if IsTransient(err) {
+		resilientStore.failures++
+		if threshold > 0 && (resilientStore.failures == threshold || testing) {
+			resilientStore.openUntil = resilientStore.now().Add(resilientStore.Config.Cooldown)
+			resilientStore.Logger.Error("circuit-opened", err, lager.Data{"failures": resilientStore.failures, "cooldown": resilientStore.Config.Cooldown.String()})
+			resilientStore.Observer.ObserveCircuit(true)
+		}
+		return
+	}
+
+	if threshold > 0 && resilientStore.failures >= threshold {
+		resilientStore.Logger.Info("circuit-closed")
+		resilientStore.Observer.ObserveCircuit(false)
+	}
+	resilientStore.failures = 0
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+)
+
+var errConnectionRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+// flakyStore fails every call with err. While block is set calls wait for it
+// to be closed, after telling entered that they started.
+type flakyStore struct {
+	Store
+
+	mutex   sync.Mutex
+	calls   int
+	err     error
+	block   chan struct{}
+	entered chan struct{}
+}
+
+func (flakyStore *flakyStore) call() error {
+	flakyStore.mutex.Lock()
+	flakyStore.calls++
+	err, block, entered := flakyStore.err, flakyStore.block, flakyStore.entered
+	flakyStore.mutex.Unlock()
+
+	if entered != nil {
+		entered <- struct{}{}
+	}
+	if block != nil {
+		<-block
+	}
+	return err
+}
+
+func (flakyStore *flakyStore) callCount() int {
+	flakyStore.mutex.Lock()
+	defer flakyStore.mutex.Unlock()
+	return flakyStore.calls
+}
+
+func (flakyStore *flakyStore) GetLatestVersion(name string) (credentials.Credential, error) {
+	return credentials.Credential{}, flakyStore.call()
+}
+
+func (flakyStore *flakyStore) SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error) {
+	return credentials.JSON{}, flakyStore.call()
+}
+
+func (flakyStore *flakyStore) GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error) {
+	return credentials.Password{}, flakyStore.call()
+}
+
+type recordingObserver struct {
+	mutex    sync.Mutex
+	retries  int
+	rejected int
+	circuit  []bool
+}
+
+func (observer *recordingObserver) ObserveRetry(method string, err error) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.retries++
+}
+
+func (observer *recordingObserver) ObserveRejected(method string) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.rejected++
+}
+
+func (observer *recordingObserver) ObserveCircuit(open bool) {
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	observer.circuit = append(observer.circuit, open)
+}
+
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Sleep(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.sleeps = append(clock.sleeps, duration)
+}
+
+func (clock *fakeClock) Advance(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(duration)
+}
+
+func newTestResilientStore(store Store, config ResilienceConfig) (*ResilientStore, *recordingObserver, *fakeClock) {
+	logger := lager.NewLogger("test")
+	logger.RegisterSink(lager.NewWriterSink(ioutil.Discard, lager.DEBUG))
+
+	observer := &recordingObserver{}
+	clock := &fakeClock{now: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	resilientStore := NewResilientStore(store, config, observer, logger)
+	resilientStore.now = clock.Now
+	resilientStore.sleep = clock.Sleep
+	return resilientStore, observer, clock
+}
+
+func TestResilientStoreRetriesTransientFailuresWithBackoff(t *testing.T) {
+	inner := &flakyStore{err: errConnectionRefused}
+	config := ResilienceConfig{Attempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	resilientStore, observer, clock := newTestResilientStore(inner, config)
+
+	_, err := resilientStore.GetLatestVersion("/a")
+	if err != errConnectionRefused {
+		t.Errorf("expected the last error, got %v", err)
+	}
+	if inner.callCount() != 4 || observer.retries != 3 {
+		t.Errorf("expected 4 calls and 3 retries, got %d and %d", inner.callCount(), observer.retries)
+	}
+
+	ceilings := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}
+	if len(clock.sleeps) != len(ceilings) {
+		t.Fatalf("expected %d sleeps, got %v", len(ceilings), clock.sleeps)
+	}
+	for i, sleep := range clock.sleeps {
+		if sleep < 0 || sleep > ceilings[i] {
+			t.Errorf("expected sleep %d to be at most %s, got %s", i, ceilings[i], sleep)
+		}
+	}
+}
+
+func TestResilientStoreRetries(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	for _, test := range []struct {
+		name    string
+		err     error
+		block   bool
+		call    func(store *ResilientStore) error
+		calls   int
+		lastErr error
+	}{
+		{"rejected reads", ErrNotFound, false, getLatestVersion, 1, ErrNotFound},
+		{"unreachable writes", errConnectionRefused, false, setJSON, 3, errConnectionRefused},
+		{"rejected writes", ErrTypeModified, false, setJSON, 1, ErrTypeModified},
+		{"timed out reads", nil, true, getLatestVersion, 3, ErrTimeout},
+		{"timed out writes", nil, true, setJSON, 1, ErrTimeout},
+		{"unreachable generates", errConnectionRefused, false, generatePassword, 1, errConnectionRefused},
+	} {
+		inner := &flakyStore{err: test.err}
+		if test.block {
+			inner.block = make(chan struct{})
+		}
+		resilientStore, _, _ := newTestResilientStore(inner, ResilienceConfig{Attempts: 3, Timeout: timeout})
+
+		err := test.call(resilientStore)
+		if test.block {
+			close(inner.block)
+		}
+		if err != test.lastErr {
+			t.Errorf("%s: expected %v, got %v", test.name, test.lastErr, err)
+		}
+		if inner.callCount() != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.name, test.calls, inner.callCount())
+		}
+	}
+}
+
+func getLatestVersion(store *ResilientStore) error {
+	_, err := store.GetLatestVersion("/a")
+	return err
+}
+
+func setJSON(store *ResilientStore) error {
+	_, err := store.SetJSON("/a", values.JSON{}, credhub.Overwrite)
+	return err
+}
+
+func generatePassword(store *ResilientStore) error {
+	_, err := store.GeneratePassword("/a", generate.Password{}, credhub.Overwrite)
+	return err
+}
+
+func TestResilientStoreCircuitBreaker(t *testing.T) {
+	inner := &flakyStore{err: errConnectionRefused}
+	config := ResilienceConfig{Attempts: 1, FailureThreshold: 2, Cooldown: 30 * time.Second}
+	resilientStore, observer, clock := newTestResilientStore(inner, config)
+
+	retryAfter := func() time.Duration {
+		t.Helper()
+		calls := inner.callCount()
+		err := getLatestVersion(resilientStore)
+		unavailableErr, ok := err.(*UnavailableError)
+		if !ok {
+			t.Fatalf("expected the call to be rejected, got %v", err)
+		}
+		if inner.callCount() != calls {
+			t.Fatal("expected a rejected call not to reach CredHub")
+		}
+		return unavailableErr.RetryAfter
+	}
+
+	// closed: failures below the threshold reach CredHub
+	getLatestVersion(resilientStore)
+	if observer.circuit != nil {
+		t.Fatalf("expected the circuit to stay closed, got %v", observer.circuit)
+	}
+
+	// open: the failure that reaches the threshold opens it for the cooldown
+	getLatestVersion(resilientStore)
+	if !reflect.DeepEqual(observer.circuit, []bool{true}) {
+		t.Fatalf("expected the circuit to open, got %v", observer.circuit)
+	}
+	if wait := retryAfter(); wait != 30*time.Second {
+		t.Errorf("expected to retry after 30s, got %s", wait)
+	}
+	clock.Advance(10 * time.Second)
+	if wait := retryAfter(); wait != 20*time.Second {
+		t.Errorf("expected to retry after 20s, got %s", wait)
+	}
+
+	// half-open: after the cooldown a single call tests CredHub, and its
+	// failure opens the circuit again
+	clock.Advance(20 * time.Second)
+	if err := getLatestVersion(resilientStore); err != errConnectionRefused {
+		t.Fatalf("expected the test call to reach CredHub, got %v", err)
+	}
+	if !reflect.DeepEqual(observer.circuit, []bool{true, true}) {
+		t.Fatalf("expected the circuit to open again, got %v", observer.circuit)
+	}
+	if wait := retryAfter(); wait != 30*time.Second {
+		t.Errorf("expected to retry after 30s, got %s", wait)
+	}
+
+	// while the test call is in progress other calls are rejected
+	clock.Advance(30 * time.Second)
+	release, entered := make(chan struct{}), make(chan struct{})
+	inner.mutex.Lock()
+	inner.err, inner.block, inner.entered = nil, release, entered
+	inner.mutex.Unlock()
+
+	done := make(chan error)
+	go func() { done <- getLatestVersion(resilientStore) }()
+	<-entered
+
+	inner.mutex.Lock()
+	inner.block, inner.entered = nil, nil
+	inner.mutex.Unlock()
+	if wait := retryAfter(); wait != time.Second {
+		t.Errorf("expected to retry after 1s while CredHub is tested, got %s", wait)
+	}
+
+	// closed: the test call succeeding closes the circuit
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("expected the test call to succeed, got %v", err)
+	}
+	if !reflect.DeepEqual(observer.circuit, []bool{true, true, false}) {
+		t.Fatalf("expected the circuit to close, got %v", observer.circuit)
+	}
+	if err := getLatestVersion(resilientStore); err != nil {
+		t.Errorf("expected calls to reach CredHub again, got %v", err)
+	}
+	if observer.rejected != 4 {
+		t.Errorf("expected 4 rejected calls, got %d", observer.rejected)
+	}
+}
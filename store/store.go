@@ -0,0 +1,58 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/generate"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/credentials/values"
+	"github.com/cloudfoundry-incubator/credhub-cli/credhub/permissions"
+)
+
+var (
+	// ErrNotFound is returned when a credential or permission does not exist.
+	ErrNotFound = errors.New("credential does not exist")
+
+	// ErrTypeModified is returned when writing a credential with a different
+	// type than its existing versions.
+	ErrTypeModified = errors.New("The credential type cannot be modified. Please delete the credential if you wish to create it with a different type.")
+
+	// ErrNotGenerated is returned when regenerating a credential whose value
+	// was set rather than generated.
+	ErrNotGenerated = errors.New("The credential could not be regenerated because the value was statically set. Only generated credentials may be regenerated.")
+)
+
+// Store is the subset of the CredHub API used by the broker.
+type Store interface {
+	SetValue(name string, value values.Value, mode credhub.Mode) (credentials.Value, error)
+	SetJSON(name string, value values.JSON, mode credhub.Mode) (credentials.JSON, error)
+	SetPassword(name string, value values.Password, mode credhub.Mode) (credentials.Password, error)
+	SetUser(name string, value values.User, mode credhub.Mode) (credentials.User, error)
+	SetCertificate(name string, value values.Certificate, mode credhub.Mode) (credentials.Certificate, error)
+	SetRSA(name string, value values.RSA, mode credhub.Mode) (credentials.RSA, error)
+	SetSSH(name string, value values.SSH, mode credhub.Mode) (credentials.SSH, error)
+
+	GeneratePassword(name string, gen generate.Password, mode credhub.Mode) (credentials.Password, error)
+	GenerateUser(name string, gen generate.User, mode credhub.Mode) (credentials.User, error)
+	GenerateCertificate(name string, gen generate.Certificate, mode credhub.Mode) (credentials.Certificate, error)
+	GenerateRSA(name string, gen generate.RSA, mode credhub.Mode) (credentials.RSA, error)
+	GenerateSSH(name string, gen generate.SSH, mode credhub.Mode) (credentials.SSH, error)
+	Regenerate(name string) (credentials.Credential, error)
+
+	GetLatestValue(name string) (credentials.Value, error)
+	GetLatestJSON(name string) (credentials.JSON, error)
+	GetLatestVersion(name string) (credentials.Credential, error)
+	GetById(id string) (credentials.Credential, error)
+	GetAllVersions(name string) ([]credentials.Credential, error)
+	GetNVersions(name string, numberOfVersions int) ([]credentials.Credential, error)
+
+	Delete(name string) error
+
+	FindByPath(path string) (credentials.FindResults, error)
+	FindAllPaths() (credentials.Paths, error)
+
+	GetPermissions(name string) ([]permissions.Permission, error)
+	AddPermissions(name string, perms []permissions.Permission) error
+	DeletePermissions(name string, actor string) error
+}